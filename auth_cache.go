@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authCache global cache of recently verified credentials
+var authCache = &credentialCache{entries: make(map[string]*credential)}
+
+// credential is a password verified by the IMAP server
+type credential struct {
+	// salted bcrypt hash of the password
+	hash    []byte
+	expires time.Time
+}
+
+// credentialCache remembers successful logins for the configured TTL, so the
+// password can be verified locally instead of by logging in to the IMAP
+// server. Only a slow salted hash of the password is kept.
+type credentialCache struct {
+	sync.Mutex
+	entries map[string]*credential
+}
+
+// Verify returns true if pass matches the cached password of user. A miss
+// means that the credentials must be verified by the IMAP server.
+func (c *credentialCache) Verify(user, pass string) bool {
+	c.Lock()
+	entry, ok := c.entries[user]
+	c.Unlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(entry.hash, []byte(pass)) == nil
+}
+
+// Store caches the password of user after a successful login
+func (c *credentialCache) Store(user, pass string) {
+	ttl := authCacheTTL()
+	if ttl <= 0 {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		Log.Errorf("unable to hash password of %s: %s", user, err)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// forget expired entries
+	now := time.Now()
+	for u, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, u)
+		}
+	}
+
+	c.entries[user] = &credential{hash: hash, expires: now.Add(ttl)}
+}
+
+// Forget removes the cached password of user, e.g. when the IMAP server has
+// rejected it
+func (c *credentialCache) Forget(user string) {
+	c.Lock()
+	delete(c.entries, user)
+	c.Unlock()
+}
+
+// get the time a verified password is cached, 0 disables the cache
+func authCacheTTL() time.Duration {
+	return time.Duration(Conf.Login.CacheTTL) * time.Second
+}
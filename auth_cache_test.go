@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCache(ttl int) *credentialCache {
+	Conf = &ServerConfig{Login: loginLimit{CacheTTL: ttl}}
+	return &credentialCache{entries: make(map[string]*credential)}
+}
+
+func TestCredentialCache(t *testing.T) {
+	c := testCache(300)
+
+	if c.Verify("user", "secret") {
+		t.Fatal("password verified before it was cached")
+	}
+
+	c.Store("user", "secret")
+
+	if !c.Verify("user", "secret") {
+		t.Error("cached password not verified")
+	}
+	if c.Verify("user", "wrong") {
+		t.Error("wrong password verified")
+	}
+	if c.Verify("other", "secret") {
+		t.Error("password verified for another user")
+	}
+
+	c.Forget("user")
+	if c.Verify("user", "secret") {
+		t.Error("password verified after Forget")
+	}
+}
+
+func TestCredentialCacheExpiry(t *testing.T) {
+	c := testCache(300)
+
+	c.Store("user", "secret")
+	c.Store("old", "secret")
+	c.entries["user"].expires = time.Now().Add(-time.Second)
+	c.entries["old"].expires = time.Now().Add(-time.Second)
+
+	if c.Verify("user", "secret") {
+		t.Error("expired password verified")
+	}
+
+	// expired entries are forgotten when storing another password
+	c.Store("user", "secret")
+	if _, ok := c.entries["old"]; ok {
+		t.Error("expired entry kept")
+	}
+	if !c.Verify("user", "secret") {
+		t.Error("password not verified after storing it again")
+	}
+}
+
+func TestCredentialCacheDisabled(t *testing.T) {
+	c := testCache(0)
+
+	c.Store("user", "secret")
+	if c.Verify("user", "secret") {
+		t.Error("password cached with cache_ttl = 0")
+	}
+}
+
+// fakeIMAPLogin starts an IMAP server on a local listener refusing every login
+func fakeIMAPLogin(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				fmt.Fprintf(conn, "* OK fake IMAP server ready\r\n")
+
+				for {
+					cmd, err := readFakeCommand(r, conn)
+					if err != nil {
+						return
+					}
+
+					fields := strings.Fields(cmd)
+					if strings.ToUpper(fields[1]) == "LOGIN" {
+						fmt.Fprintf(conn, "%s NO [AUTHENTICATIONFAILED] invalid credentials\r\n", fields[0])
+					} else {
+						fmt.Fprintf(conn, "%s OK %s completed\r\n", fields[0], fields[1])
+					}
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestCredentialCacheForgetOnAuthFailure(t *testing.T) {
+	l := fakeIMAPLogin(t)
+	defer l.Close()
+
+	addr := l.Addr().(*net.TCPAddr)
+	Conf = &ServerConfig{
+		IMAP:  imapClient{Server: addr.IP.String(), Port: addr.Port, TLS: tlsNone},
+		Login: loginLimit{CacheTTL: 300},
+	}
+	authCache = &credentialCache{entries: make(map[string]*credential)}
+
+	// the password has been changed since it was cached
+	authCache.Store("user", "old")
+
+	k := &KUmail{User: "user", Pass: "new", settings: &Settings{}}
+	err := k.connect()
+	if lerr, ok := err.(*LoginError); !ok || lerr.Code != respAuth {
+		t.Fatalf("expected an AUTH login error, got %v", err)
+	}
+
+	if authCache.Verify("user", "old") {
+		t.Error("password still cached after the IMAP server rejected a login")
+	}
+}
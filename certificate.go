@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how often to check if the certificate files have changed on disk
+const certCheckInterval = time.Minute
+
+// certLoader holds a certificate/key pair which is reloaded when the files
+// change on disk or when the process receives SIGHUP
+type certLoader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// newCertLoader loads the certificate/key pair and starts watching the files
+// for changes
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	c := &certLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.watch()
+
+	return c, nil
+}
+
+// GetCertificate returns the current certificate. Used as
+// tls.Config.GetCertificate
+func (c *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// reload reads the certificate/key pair from disk
+func (c *certLoader) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	c.mutex.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mutex.Unlock()
+
+	Log.Infof("Loaded certificate %s (expires %s)", c.certFile, leaf.NotAfter)
+	return nil
+}
+
+// watch reloads the certificate when the files are modified or the process
+// receives SIGHUP. If the reload fails the old certificate is kept.
+func (c *certLoader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			Log.Infof("Got SIGHUP, reloading certificate %s", c.certFile)
+		case <-ticker.C:
+			modTime, err := c.lastModified()
+			if err != nil {
+				Log.Errorf("unable to stat certificate: %s", err)
+				continue
+			}
+
+			c.mutex.RLock()
+			changed := modTime.After(c.modTime)
+			c.mutex.RUnlock()
+
+			if !changed {
+				continue
+			}
+		}
+
+		err := c.reload()
+		if err != nil {
+			Log.Errorf("unable to reload certificate: %s", err)
+		}
+	}
+}
+
+// get the latest modification time of the certificate and key files
+func (c *certLoader) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 
 	"github.com/BurntSushi/toml"
@@ -8,24 +9,86 @@ import (
 
 // ServerConfig defining configuration for pop, imap
 type ServerConfig struct {
-	POP  pop
-	IMAP imapClient
-	DB   db
-	HTTP httpClient
+	POP   pop
+	IMAP  imapClient
+	DB    db
+	HTTP  httpClient
+	Login loginLimit
 }
 
+// TLS modes of a POP3 listener and of the IMAP connection
+const (
+	tlsImplicit = "implicit" // TLS from the beginning of the connection
+	tlsSTLS     = "stls"     // plaintext, can be upgraded to TLS with STLS
+	tlsSTARTTLS = "starttls" // plaintext, upgraded to TLS with STARTTLS (IMAP)
+	tlsNone     = "none"     // plaintext only
+)
+
 type pop struct {
-	Port int
-	TLS  bool
-	Cert string
-	Key  string
+	Port             int
+	TLS              bool
+	Cert             string
+	Key              string
+	Timeout          int
+	RequireTLS       bool          `toml:"require_tls"`
+	MaxErrors        int           `toml:"max_errors"`
+	LoginDelay       int           `toml:"login_delay"`
+	ShutdownTimeout  int           `toml:"shutdown_timeout"`
+	MaxSessions      int           `toml:"max_sessions"`
+	MaxSessionsPerIP int           `toml:"max_sessions_per_ip"`
+	Listener         []popListener `toml:"listener"`
+}
+
+type popListener struct {
+	Address string
+	TLS     string
+	Cert    string
+	Key     string
 }
 
+// Listeners returns the configured POP3 listeners. If no listeners are
+// configured, a single listener is defined from port, tls, cert and key.
+func (p *pop) Listeners() []popListener {
+	if len(p.Listener) > 0 {
+		return p.Listener
+	}
+
+	l := popListener{
+		Address: fmt.Sprintf(":%d", p.Port),
+		TLS:     tlsNone,
+		Cert:    p.Cert,
+		Key:     p.Key,
+	}
+
+	if p.TLS {
+		l.TLS = tlsImplicit
+	} else if p.Cert != "" {
+		l.TLS = tlsSTLS
+	}
+
+	return []popListener{l}
+}
+
+// sources of the unique-ids returned by UIDL
+const (
+	uidlUID       = "uid"        // UIDVALIDITY and UID of the message
+	uidlMessageID = "message-id" // hash of the Message-ID header
+)
+
 type imapClient struct {
-	Server     string
-	Port       int
-	AddressFmt string `toml:"address_fmt"`
-	Folder     string
+	Server      string
+	Port        int
+	TLS         string
+	CA          string
+	Timeout     int
+	ServerName  string `toml:"server_name"`
+	DialTimeout int    `toml:"dial_timeout"`
+	AddressFmt  string `toml:"address_fmt"`
+	Folder      string
+	Archive     string
+	UIDL        string
+	PoolSize    int `toml:"pool_size"`
+	PoolIdle    int `toml:"pool_idle"`
 }
 
 type db struct {
@@ -41,6 +104,13 @@ type httpClient struct {
 	Port int
 }
 
+type loginLimit struct {
+	MaxFailures    int `toml:"max_failures"`
+	MaxFailedUsers int `toml:"max_failed_users"`
+	Lockout        int
+	CacheTTL       int `toml:"cache_ttl"`
+}
+
 // MustReadServerConfig from path
 func MustReadServerConfig(path string) *ServerConfig {
 	config, err := ReadServerConfig(path)
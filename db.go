@@ -15,6 +15,8 @@ const table = "user_settings"
 
 var usernameRe = regexp.MustCompile(`^[b-df-hj-np-tv-xz]{3}\d{3}$`)
 
+var errInvalidUsername = errors.New("invalid ku-username format")
+
 // Settings user_settings
 type Settings struct {
 	User          string
@@ -22,6 +24,7 @@ type Settings struct {
 	FromWhitelist []string
 	ToWhitelist   []string
 	Blacklist     []string
+	Archive       bool // archive deleted mails instead of expunging them
 }
 
 // Whitelist a combined list of FromWhitelist and ToWhitelist
@@ -43,7 +46,7 @@ func connect() (*sql.DB, error) {
 // GetSettings get settings for user
 func GetSettings(user string) (*Settings, error) {
 	if !usernameRe.MatchString(user) {
-		return nil, errors.New("invalid ku-username format")
+		return nil, errInvalidUsername
 	}
 
 	db, err := connect()
@@ -59,14 +62,14 @@ func GetSettings(user string) (*Settings, error) {
 
 	switch Conf.DB.Type {
 	case "mysql":
-		stmt = fmt.Sprintf("SELECT username, workmail, fromwhitelist, towhitelist, blacklist FROM %s WHERE username=?", table)
+		stmt = fmt.Sprintf("SELECT username, workmail, fromwhitelist, towhitelist, blacklist, archive FROM %s WHERE username=?", table)
 	default:
-		stmt = fmt.Sprintf("SELECT username, workmail, fromwhitelist, towhitelist, blacklist FROM %s WHERE username=$1", table)
+		stmt = fmt.Sprintf("SELECT username, workmail, fromwhitelist, towhitelist, blacklist, archive FROM %s WHERE username=$1", table)
 	}
 
 	row := db.QueryRow(stmt, user)
 	s := new(Settings)
-	err = row.Scan(&s.User, &s.Workmail, &from, &to, &blacklist)
+	err = row.Scan(&s.User, &s.Workmail, &from, &to, &blacklist, &s.Archive)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -91,9 +94,9 @@ func (s *Settings) Create() error {
 
 	switch Conf.DB.Type {
 	case "mysql":
-		stmt = fmt.Sprintf("INSERT INTO %s (username, workmail, fromwhitelist, towhitelist, blacklist) VALUES (?, ?, ?, ?, ?)", table)
+		stmt = fmt.Sprintf("INSERT INTO %s (username, workmail, fromwhitelist, towhitelist, blacklist, archive) VALUES (?, ?, ?, ?, ?, ?)", table)
 	default:
-		stmt = fmt.Sprintf("INSERT INTO %s (username, workmail, fromwhitelist, towhitelist, blacklist) VALUES ($1, $2, $3, $4, $5)", table)
+		stmt = fmt.Sprintf("INSERT INTO %s (username, workmail, fromwhitelist, towhitelist, blacklist, archive) VALUES ($1, $2, $3, $4, $5, $6)", table)
 	}
 
 	_, err = db.Exec(
@@ -102,7 +105,8 @@ func (s *Settings) Create() error {
 		s.Workmail,
 		joinWithoutEmpty(s.FromWhitelist, ";"),
 		joinWithoutEmpty(s.ToWhitelist, ";"),
-		joinWithoutEmpty(s.Blacklist, ";"))
+		joinWithoutEmpty(s.Blacklist, ";"),
+		s.Archive)
 
 	return err
 }
@@ -119,9 +123,9 @@ func (s *Settings) Update() error {
 
 	switch Conf.DB.Type {
 	case "mysql":
-		stmt = fmt.Sprintf("UPDATE %s SET workmail=?, fromwhitelist=?, towhitelist=?, blacklist=? WHERE username=?", table)
+		stmt = fmt.Sprintf("UPDATE %s SET workmail=?, fromwhitelist=?, towhitelist=?, blacklist=?, archive=? WHERE username=?", table)
 	default:
-		stmt = fmt.Sprintf("UPDATE %s SET workmail=$1, fromwhitelist=$2, towhitelist=$3, blacklist=$4 WHERE username=$5", table)
+		stmt = fmt.Sprintf("UPDATE %s SET workmail=$1, fromwhitelist=$2, towhitelist=$3, blacklist=$4, archive=$5 WHERE username=$6", table)
 	}
 
 	_, err = db.Exec(
@@ -130,6 +134,7 @@ func (s *Settings) Update() error {
 		joinWithoutEmpty(s.FromWhitelist, ";"),
 		joinWithoutEmpty(s.ToWhitelist, ";"),
 		joinWithoutEmpty(s.Blacklist, ";"),
+		s.Archive,
 		s.User)
 
 	return err
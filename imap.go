@@ -1,54 +1,198 @@
 package main
 
 import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoSuchMessage  = errors.New("no such message")
+	errNotRegistered  = errors.New("account not registered")
+	errMaildropLocked = errors.New("maildrop is locked by another session")
+)
+
+const flagDeleted = `\Deleted`
 
-	"github.com/mikkeloscar/goimap"
+// default timeouts of the IMAP connection
+const (
+	defaultIMAPDialTimeout = 30 * time.Second
+	defaultIMAPTimeout     = time.Minute
 )
 
+// number of octets per body line to request when doing a partial fetch of the
+// message body for TOP
+const topLineOctets = 128
+
+// maildrops holds the users with an active session. Only one session per user
+// may organize and serve the maildrop at a time, as required by RFC 1939.
+var maildrops = &maildropLocks{users: make(map[string]bool)}
+
+type maildropLocks struct {
+	sync.Mutex
+	users map[string]bool
+}
+
+// Acquire locks the maildrop of user. Returns false if it is already locked.
+func (l *maildropLocks) Acquire(user string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.users[user] {
+		return false
+	}
+	l.users[user] = true
+	return true
+}
+
+// Release unlocks the maildrop of user
+func (l *maildropLocks) Release(user string) {
+	l.Lock()
+	delete(l.users, user)
+	l.Unlock()
+}
+
 // KUmail defines an special IMAP client for KUmail
 type KUmail struct {
 	User     string
 	Pass     string
-	client   *imap.IMAPClient
+	client   *imapConn
 	settings *Settings
+	// UIDs of the messages in the alumni folder at login, message number n
+	// maps to uids[n-1] for the whole session
+	uids        []string
+	sizes       []int
+	uidValidity uint32
+	// unique-ids of the messages, computed on the first UIDL
+	uidls []string
+	// status of INBOX when the mails were organized
+	inbox map[string]int
+	// true if the session holds the maildrop lock of the user
+	locked bool
+}
+
+// LoginError is returned by Init when the login fails. Code is the RFC 2449
+// extended response code describing the cause of the failure.
+type LoginError struct {
+	Code string
+	Err  error
 }
 
-// MsgInfo defines a struct to hold a message ID and the corresponding message
-// size
-type MsgInfo struct {
-	ID   string
-	size int // message size in octets
+func (e *LoginError) Error() string {
+	return e.Err.Error()
 }
 
-// MsgUID defines a struct to hold a message ID and the UID of that message
-type MsgUID struct {
-	ID  string
-	UID int
+// KUmailBackend is a Backend serving the alumni folder of KUmail accounts
+type KUmailBackend struct{}
+
+// Login gets the settings of user and sets up the IMAP session with Init
+func (KUmailBackend) Login(user, pass string) (Mailbox, error) {
+	settings, err := GetSettings(user)
+	if err == errInvalidUsername {
+		return nil, &LoginError{respAuth, err}
+	}
+
+	if err != nil {
+		Log.Errorf("unable to get settings for %s: %s", user, err)
+		return nil, &LoginError{respSysTemp, err}
+	}
+
+	if settings == nil {
+		return nil, &LoginError{respSysPerm, errNotRegistered}
+	}
+
+	k := &KUmail{User: user, Pass: pass}
+	err = k.Init(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
 }
 
 // Init setup a connection, authenticate with IMAP server and organize mails.
 // After this, the server will be ready to send the mails requested from the
-// subfolder
+// subfolder. A pooled session of the user is reused if there is one, in which
+// case mails are only organized if INBOX or the settings changed.
 // assumes User and Pass has been initialized in k
-func (k *KUmail) Init(settings *Settings) bool {
+func (k *KUmail) Init(settings *Settings) error {
 	k.settings = settings
 	alumniMail := fmt.Sprintf(Conf.IMAP.AddressFmt, k.User)
 	k.settings.ToWhitelist = append(k.settings.ToWhitelist, alumniMail)
-	service := fmt.Sprintf("%s:%d", Conf.IMAP.Server, Conf.IMAP.Port)
 
-	conn, err := net.Dial("tcp", service)
+	// a pooled session set up with other settings might lack mailboxes
+	session := imapSessions.Get(k.User, k.Pass)
+	if session != nil && !reflect.DeepEqual(session.settings, *k.settings) {
+		logoutIMAP(session.client)
+		session = nil
+	}
+
+	if session != nil {
+		k.client = session.client
+	} else {
+		err := k.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the maildrop is locked once the user is authenticated
+	if !maildrops.Acquire(k.User) {
+		Log.Infof("maildrop of %s is locked by another session", k.User)
+		k.logout()
+		return &LoginError{respInUse, errMaildropLocked}
+	}
+	k.locked = true
+
+	// the UIDNEXT of INBOX changes when new mail arrives
+	inbox, err := k.client.Status("INBOX", "(UIDNEXT UIDVALIDITY)")
 	if err != nil {
 		Log.Error(err.Error())
-		return false
+		k.logout()
+		return &LoginError{respSysTemp, err}
+	}
+
+	// Organize Mails just after login
+	if session == nil || !reflect.DeepEqual(session.inbox, inbox) {
+		err = k.organizeMails()
+		if err != nil {
+			Log.Error(err.Error())
+			k.logout()
+			return &LoginError{respSysTemp, err}
+		}
+	}
+
+	k.inbox = inbox
+
+	// fix the maildrop for the rest of the session
+	err = k.snapshot()
+	if err != nil {
+		Log.Error(err.Error())
+		k.logout()
+		return &LoginError{respSysTemp, err}
 	}
 
-	client, err := imap.NewClient(conn, Conf.IMAP.Server)
+	return nil
+}
+
+// connect sets up a new IMAP session and creates the mailboxes of the user
+func (k *KUmail) connect() error {
+	client, err := dialIMAP()
 	if err != nil {
 		Log.Error(err.Error())
-		return false
+		return &LoginError{respSysTemp, err}
 	}
 
 	k.client = client
@@ -56,39 +200,195 @@ func (k *KUmail) Init(settings *Settings) bool {
 	err = k.client.Login(k.User, k.Pass)
 	if err != nil {
 		Log.Error(err.Error())
-		return false
+		k.logout()
+		code := loginErrorCode(err)
+		if code == respAuth {
+			authCache.Forget(k.User)
+		}
+		return &LoginError{code, err}
 	}
 
+	authCache.Store(k.User, k.Pass)
+
 	// create sub-mailbox if it doesn't exist yet
-	err = k.createMailbox()
+	err = k.createMailbox(fmt.Sprintf("INBOX/%s", Conf.IMAP.Folder))
 	if err != nil {
 		Log.Error(err.Error())
-		return false
+		k.logout()
+		return &LoginError{respSysTemp, err}
 	}
 
-	// Organize Mails just after login
-	err = k.organizeMails()
+	// create archive mailbox if the user wants deleted mails archived
+	if k.settings.Archive {
+		err = k.createMailbox(fmt.Sprintf("INBOX/%s", Conf.IMAP.Archive))
+		if err != nil {
+			Log.Error(err.Error())
+			k.logout()
+			return &LoginError{respSysTemp, err}
+		}
+	}
+
+	return nil
+}
+
+// dialIMAP connects to the IMAP server with the configured TLS mode. Implicit
+// TLS is used if no mode is configured. The server must respond within the
+// configured timeout, or the connection fails.
+func dialIMAP() (*imapConn, error) {
+	service := net.JoinHostPort(Conf.IMAP.Server, strconv.Itoa(Conf.IMAP.Port))
+
+	var config *tls.Config
+	var err error
+
+	switch Conf.IMAP.TLS {
+	case tlsImplicit, tlsSTARTTLS, "":
+		config, err = imapTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+	case tlsNone:
+	default:
+		return nil, fmt.Errorf("invalid IMAP tls mode '%s'", Conf.IMAP.TLS)
+	}
+
+	raw, err := net.DialTimeout("tcp", service, imapDialTimeout())
 	if err != nil {
-		Log.Error(err.Error())
-		return false
+		return nil, err
 	}
 
-	return true
+	var conn net.Conn = &timeoutConn{raw, imapTimeout()}
+
+	if Conf.IMAP.TLS == tlsImplicit || Conf.IMAP.TLS == "" {
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.Handshake()
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	client, err := newIMAPConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if Conf.IMAP.TLS == tlsSTARTTLS {
+		err = client.StartTLS(config)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// get the timeout for connecting to the IMAP server
+func imapDialTimeout() time.Duration {
+	if Conf.IMAP.DialTimeout > 0 {
+		return time.Duration(Conf.IMAP.DialTimeout) * time.Second
+	}
+	return defaultIMAPDialTimeout
 }
 
-// Close logout of IMAP session and close connection
-func (k *KUmail) Close() {
-	k.client.Logout()
-	k.client.Close()
+// get the time the IMAP server has to respond to a command
+func imapTimeout() time.Duration {
+	if Conf.IMAP.Timeout > 0 {
+		return time.Duration(Conf.IMAP.Timeout) * time.Second
+	}
+	return defaultIMAPTimeout
+}
+
+// imapTLSConfig sets up the TLS config used to verify the IMAP server
+func imapTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: Conf.IMAP.Server,
+	}
+
+	if Conf.IMAP.ServerName != "" {
+		config.ServerName = Conf.IMAP.ServerName
+	}
+
+	if Conf.IMAP.CA != "" {
+		pem, err := ioutil.ReadFile(Conf.IMAP.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", Conf.IMAP.CA)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// map the error of a failed IMAP LOGIN to a POP3 response code. The IMAP
+// response codes of RFC 5530 are used to tell the failures apart, otherwise a
+// NO response means that the credentials were rejected.
+func loginErrorCode(err error) string {
+	msg := err.Error()
+
+	switch {
+	case strings.Contains(msg, "[INUSE]"):
+		return respInUse
+	case strings.Contains(msg, "[UNAVAILABLE]"):
+		return respSysTemp
+	case strings.Contains(msg, "[AUTHENTICATIONFAILED]"),
+		strings.Contains(msg, "[AUTHORIZATIONFAILED]"),
+		strings.HasPrefix(msg, "NO"):
+		return respAuth
+	default:
+		return respSysTemp
+	}
+}
+
+// Close returns the IMAP session to the pool, or logs out of it if it can't
+// be reused
+func (k *KUmail) Close() error {
+	if k.client == nil {
+		return nil
+	}
+
+	imapSessions.Put(k.User, &imapSession{
+		client:   k.client,
+		settings: *k.settings,
+		inbox:    k.inbox,
+	})
+	k.client = nil
+	k.unlock()
+	return nil
+}
+
+// logout of IMAP session and close connection
+func (k *KUmail) logout() {
+	if k.client == nil {
+		return
+	}
+	logoutIMAP(k.client)
+	k.client = nil
+	k.unlock()
 }
 
-func (k *KUmail) createMailbox() error {
-	err := k.client.Status(fmt.Sprintf("INBOX/%s", Conf.IMAP.Folder), "(messages)")
+// release the maildrop lock if it is held by k
+func (k *KUmail) unlock() {
+	if k.locked {
+		maildrops.Release(k.User)
+		k.locked = false
+	}
+}
+
+func (k *KUmail) createMailbox(mailbox string) error {
+	_, err := k.client.Status(mailbox, "(messages)")
 	if err != nil {
 		Log.Error(err.Error())
-		if err.Error()[:2] == "NO" {
+		if ierr, ok := err.(*imapError); ok && ierr.Status == "NO" {
 			// create mailbox
-			err := k.client.Create(fmt.Sprintf("INBOX/%s", Conf.IMAP.Folder))
+			err := k.client.Create(mailbox)
 			if err != nil {
 				return err
 			}
@@ -96,7 +396,7 @@ func (k *KUmail) createMailbox() error {
 	}
 
 	// subscribe to the inbox
-	err = k.client.Subscribe(fmt.Sprintf("INBOX/%s", Conf.IMAP.Folder))
+	err = k.client.Subscribe(mailbox)
 	if err != nil {
 		return err
 	}
@@ -105,7 +405,10 @@ func (k *KUmail) createMailbox() error {
 }
 
 func (k *KUmail) organizeMails() error {
-	k.client.Select("INBOX")
+	_, err := k.client.Select("INBOX")
+	if err != nil {
+		return err
+	}
 
 	uids, err := k.search()
 	if err != nil {
@@ -167,7 +470,7 @@ func (k *KUmail) moveMails(msgUIDs map[string]string, src string, dst string) er
 	}
 
 	// expunge after moving all mails and marking them Deleted in INBOX
-	_, err := k.client.Expunge()
+	err := k.client.Expunge()
 	if err != nil {
 		return err
 	}
@@ -184,18 +487,18 @@ func (k *KUmail) moveMail(msgUID string, src string, dst string) error {
 	}
 
 	// TODO handle err in StoreAddFlag
-	return k.client.StoreAddFlag(msgUID, imap.Deleted)
+	return k.client.StoreAddFlag(msgUID, flagDeleted)
 }
 
 // Make sure that the mail was not sent to work mail account
 func (k *KUmail) validateMail(msgUID string) bool {
 	fields := "BODY.PEEK[HEADER.FIELDS (FROM TO CC)]"
-	resp, err := k.client.Fetch(msgUID, fields)
-	if err != nil {
+	resps, err := k.client.Fetch(msgUID, fields, nil)
+	if err != nil || len(resps) == 0 {
 		return false
 	}
 
-	body := resp.Body
+	body := resps[0].Body()
 
 	return hasSubstring(body, k.settings.Whitelist()) || !hasSubstring(body, k.settings.Blacklist)
 }
@@ -211,7 +514,7 @@ func hasSubstring(s string, l []string) bool {
 }
 
 func (k *KUmail) searchHeader(header string, query string) ([]string, error) {
-	resp, err := k.client.Search(fmt.Sprintf("(HEADER %s \"%s\")", header, query))
+	resp, err := k.client.Search("HEADER", header, imapString(query))
 	if err != nil {
 		Log.Error(err.Error())
 		return nil, err
@@ -219,63 +522,319 @@ func (k *KUmail) searchHeader(header string, query string) ([]string, error) {
 	return resp, nil
 }
 
-// ListAll lists all the messages in the alumni folder in KUmail
-func (k *KUmail) ListAll() ([]*MsgInfo, int, error) {
-	k.client.Select(fmt.Sprintf("INBOX/%s", Conf.IMAP.Folder))
+// snapshot selects the alumni folder and records the UIDs and sizes of the
+// messages in it with a single FETCH. Mails organized into the folder later in
+// the session are not seen until the next login, as required by RFC 1939.
+func (k *KUmail) snapshot() error {
+	status, err := k.client.Select(fmt.Sprintf("INBOX/%s", Conf.IMAP.Folder))
+	if err != nil {
+		return err
+	}
 
-	resp, err := k.client.Search("ALL")
+	k.uidValidity = status.UIDValidity
+	k.uids = []string{}
+	k.sizes = []int{}
+
+	// 1:* is invalid in an empty mailbox
+	if status.Exists == 0 {
+		return nil
+	}
+
+	resps, err := k.client.Fetch("1:*", "(UID RFC822.SIZE)", nil)
 	if err != nil {
-		return []*MsgInfo{}, 0, err
+		return err
+	}
+
+	sort.Slice(resps, func(i, j int) bool {
+		return resps[i].Seq < resps[j].Seq
+	})
+
+	for _, resp := range resps {
+		// skip unsolicited FETCH responses, e.g. flag updates
+		uid, ok := resp.Items["UID"]
+		if !ok {
+			continue
+		}
+
+		k.uids = append(k.uids, uid)
+		k.sizes = append(k.sizes, resp.Int("RFC822.SIZE"))
 	}
 
-	msgs := make([]*MsgInfo, len(resp))
+	return nil
+}
+
+// List lists the size of all the messages in the alumni folder in KUmail
+func (k *KUmail) List() ([]int, error) {
+	sizes := make([]int, len(k.sizes))
+	copy(sizes, k.sizes)
+	return sizes, nil
+}
 
-	total := 0
+// Size gets the size of message number n in the alumni folder
+func (k *KUmail) Size(n int) (int, error) {
+	if n < 1 || n > len(k.sizes) {
+		return 0, errNoSuchMessage
+	}
+
+	return k.sizes[n-1], nil
+}
+
+// UIDs lists the unique-id of all the messages in the alumni folder
+func (k *KUmail) UIDs() ([]string, error) {
+	uidls, err := k.uniqueIDs()
+	if err != nil {
+		return nil, err
+	}
 
-	for i, id := range resp {
-		res, err := k.client.GetMessageSize(id)
+	uids := make([]string, len(uidls))
+	copy(uids, uidls)
+	return uids, nil
+}
+
+// UID gets the unique-id of message number n in the alumni folder
+func (k *KUmail) UID(n int) (string, error) {
+	if n < 1 || n > len(k.uids) {
+		return "", errNoSuchMessage
+	}
+
+	uidls, err := k.uniqueIDs()
+	if err != nil {
+		return "", err
+	}
+
+	return uidls[n-1], nil
+}
+
+// uniqueIDs builds the unique-ids of the messages from the UIDVALIDITY of the
+// alumni folder and the UIDs, so they stay unique if the folder is recreated.
+// If configured, a hash of the Message-ID is used instead for messages with a
+// Message-ID. Copies sharing a Message-ID get the hash followed by the UID
+// based unique-id, as unique-ids must be unique within the maildrop.
+func (k *KUmail) uniqueIDs() ([]string, error) {
+	if k.uidls != nil {
+		return k.uidls, nil
+	}
+
+	uidls := make([]string, len(k.uids))
+	for i, uid := range k.uids {
+		uidls[i] = fmt.Sprintf("%d.%s", k.uidValidity, uid)
+	}
+
+	if Conf.IMAP.UIDL == uidlMessageID && len(k.uids) > 0 {
+		ids, err := k.messageIDs()
 		if err != nil {
-			return []*MsgInfo{}, 0, err
+			return nil, err
+		}
+
+		// UIDs are ascending, so the oldest copy of a message gets the
+		// bare hash while later copies are told apart by their UID
+		seen := make(map[string]bool)
+		for i, uid := range k.uids {
+			id, ok := ids[uid]
+			if !ok {
+				continue
+			}
+
+			sum := sha1.Sum([]byte(id))
+			hash := hex.EncodeToString(sum[:])
+			if seen[id] {
+				hash = fmt.Sprintf("%s.%s", hash, uidls[i])
+			}
+			seen[id] = true
+			uidls[i] = hash
+		}
+	}
+
+	k.uidls = uidls
+	return uidls, nil
+}
+
+// get the Message-ID of the messages in the snapshot, mapped by UID. Messages
+// without a Message-ID header are left out.
+func (k *KUmail) messageIDs() (map[string]string, error) {
+	// the snapshot covers every message in the folder, messages added since
+	// are left out as their UIDs are unknown
+	resps, err := k.client.Fetch("1:*", "(UID BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)])", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]string)
+	for _, resp := range resps {
+		header := resp.Body()
+
+		idx := strings.IndexByte(header, ':')
+		if idx < 0 {
+			continue
+		}
+
+		// unfold the header value
+		id := strings.Join(strings.Fields(header[idx+1:]), "")
+		if id != "" {
+			ids[resp.Items["UID"]] = id
+		}
+	}
+
+	return ids, nil
+}
+
+// messageUID maps message number n to the UID of the message in the alumni
+// folder. errNoSuchMessage is returned if n is out of range.
+func (k *KUmail) messageUID(n int) (string, error) {
+	if n < 1 || n > len(k.uids) {
+		return "", errNoSuchMessage
+	}
+
+	return k.uids[n-1], nil
+}
+
+// Fetch fetches message number n. The message is streamed from the IMAP
+// literal to fn as it is received from the server.
+func (k *KUmail) Fetch(n int, fn func(r io.Reader) error) error {
+	uid, err := k.messageUID(n)
+	if err != nil {
+		return err
+	}
+
+	found := false
+
+	literal := func(prefix string, size int64, r io.Reader) (string, error) {
+		// only stream the message body, other literals, e.g. from
+		// unsolicited responses, are read as usual. Only a single message
+		// is fetched so the first RFC822 literal is the requested message.
+		fields := strings.Fields(strings.ToUpper(prefix))
+		if found || len(fields) < 4 || fields[2] != "FETCH" || strings.TrimLeft(fields[len(fields)-1], "(") != "RFC822" {
+			return readLiteral(r)
 		}
-		total += res
 
-		msgs[i] = &MsgInfo{id, res}
+		found = true
+		return "NIL", fn(r)
+	}
+
+	_, err = k.client.UIDFetch(uid, "RFC822", literal)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return errNoSuchMessage
 	}
 
-	return msgs, total, nil
+	return nil
 }
 
-// UIDL lists all the messages in the alumni folder along with there UID
-func (k *KUmail) UIDL() ([]*MsgUID, error) {
-	k.client.Select(fmt.Sprintf("INBOX/%s", Conf.IMAP.Folder))
+// Top fetches the headers and the first `lines` lines of the body of message
+// number n. The body is fetched with IMAP partial fetches which are extended
+// until enough lines have been received.
+func (k *KUmail) Top(n, lines int) (string, error) {
+	uid, err := k.messageUID(n)
+	if err != nil {
+		return "", err
+	}
 
-	resp, err := k.client.Search("ALL")
+	resps, err := k.client.UIDFetch(uid, "BODY.PEEK[HEADER]", nil)
 	if err != nil {
-		return []*MsgUID{}, err
+		return "", err
 	}
 
-	msgs := make([]*MsgUID, len(resp))
+	if len(resps) == 0 {
+		return "", errNoSuchMessage
+	}
+
+	header := resps[0].Body()
+
+	if lines == 0 {
+		return header, nil
+	}
 
-	for i, id := range resp {
-		res, err := k.client.Fetch(id, "UID")
+	// the body is never larger than the whole message, which also keeps
+	// the partial fetch size from overflowing for huge line counts
+	maxSize := k.sizes[n-1]
+	if maxSize < 1 {
+		maxSize = 1
+	}
+
+	size := maxSize
+	if lines < maxSize/topLineOctets {
+		size = lines * topLineOctets
+	}
+
+	for {
+		resps, err := k.client.UIDFetch(uid, fmt.Sprintf("BODY.PEEK[TEXT]<0.%d>", size), nil)
 		if err != nil {
-			return []*MsgUID{}, err
+			return "", err
 		}
 
-		msgs[i] = &MsgUID{id, res.Value}
+		if len(resps) == 0 {
+			return "", errNoSuchMessage
+		}
+
+		text := resps[0].Body()
+
+		body, ok := firstLines(text, lines)
+		// if less than size octets were returned we got the whole body
+		if ok || len(text) < size || size == maxSize {
+			return header + body, nil
+		}
+
+		size *= 4
+		if size > maxSize {
+			size = maxSize
+		}
 	}
+}
 
-	return msgs, nil
+// get the first n lines of s. Returns false if s contains less than n complete
+// lines
+func firstLines(s string, n int) (string, bool) {
+	end := 0
+	for i := 0; i < n; i++ {
+		idx := strings.IndexByte(s[end:], '\n')
+		if idx < 0 {
+			return s, false
+		}
+		end += idx + 1
+	}
+	return s[:end], true
 }
 
-// GetMessage fetches message with ID `id`
-func (k *KUmail) GetMessage(id string) (string, int, error) {
-	k.client.Select(fmt.Sprintf("INBOX/%s", Conf.IMAP.Folder))
+// Delete removes the messages with numbers ns from the alumni folder. If the
+// user has chosen to archive deleted mails, the messages are moved to the
+// archive folder instead of just being expunged. Only the deleted messages
+// are expunged, other messages marked as \Deleted, e.g. by a mail client using
+// IMAP, are left alone.
+func (k *KUmail) Delete(ns []int) error {
+	uids := make([]string, 0, len(ns))
 
-	resp, err := k.client.Fetch(id, imap.RFC822)
+	for _, n := range ns {
+		uid, err := k.messageUID(n)
+		if err != nil {
+			continue
+		}
+		uids = append(uids, uid)
+
+		if k.settings.Archive {
+			err = k.client.UIDCopy(uid, fmt.Sprintf("INBOX/%s", Conf.IMAP.Archive))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = k.client.UIDStoreAddFlag(uid, flagDeleted)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	err := k.client.UIDExpunge(strings.Join(uids, ","))
 	if err != nil {
-		return "", 0, err
+		return err
 	}
 
-	return resp.Body, resp.Length, nil
+	Log.Infof("Deleted %d mails (%s)", len(uids), k.User)
+	return nil
 }
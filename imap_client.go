@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapConn is a minimal IMAP4rev1 (RFC 3501) client implementing the commands
+// used by KUmail. Literals in responses can be handled by a callback, which
+// makes it possible to stream message bodies instead of buffering them.
+//
+// It replaces github.com/mikkeloscar/goimap, whose Fetch returns every literal
+// as a string, so each RETR held the whole message in memory, and which has no
+// hooks for timeouts, STARTTLS or the UID commands the maildrop snapshot
+// relies on. Only the small subset of IMAP used by KUmail is implemented;
+// anything beyond that should go into a maintained client instead.
+type imapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	tag    int
+	// err is set if reading or writing the connection failed, after which
+	// the connection is unusable
+	err error
+}
+
+// timeoutConn is a net.Conn where every read and write must complete within
+// timeout. Unlike a single deadline, the timeout applies to each operation so
+// a long response streamed in many reads doesn't time out as long as the
+// server keeps sending.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// imapError is returned when the server completes a command with NO or BAD
+type imapError struct {
+	Status string
+	Text   string
+}
+
+func (e *imapError) Error() string {
+	return e.Status + " " + e.Text
+}
+
+// imapLiteral is a command argument which is sent as a synchronizing literal
+type imapLiteral string
+
+// literalFunc handles a literal of size octets in a server response. prefix is
+// the part of the response preceding the literal and the literal is read from
+// r. The returned string is put in place of the literal in the response.
+type literalFunc func(prefix string, size int64, r io.Reader) (string, error)
+
+// fetchResponse holds the data items of a FETCH response
+type fetchResponse struct {
+	Seq   int
+	Items map[string]string
+}
+
+// Int returns the value of a numeric data item, e.g. UID or RFC822.SIZE
+func (f *fetchResponse) Int(item string) int {
+	n, _ := strconv.Atoi(f.Items[item])
+	return n
+}
+
+// Body returns the value of the first body data item, e.g. BODY[HEADER] or
+// RFC822
+func (f *fetchResponse) Body() string {
+	for item, value := range f.Items {
+		if strings.HasPrefix(item, "BODY[") || (strings.HasPrefix(item, "RFC822") && item != "RFC822.SIZE") {
+			return value
+		}
+	}
+	return ""
+}
+
+// mailboxStatus holds the information returned when selecting a mailbox
+type mailboxStatus struct {
+	Exists      int
+	UIDValidity uint32
+}
+
+// newIMAPConn sets up an IMAP client on conn and reads the server greeting
+func newIMAPConn(conn net.Conn) (*imapConn, error) {
+	c := &imapConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+
+	greeting, err := c.readResponse(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", greeting)
+	}
+
+	return c, nil
+}
+
+// Login authenticates with the IMAP server
+func (c *imapConn) Login(user, pass string) error {
+	_, err := c.execute(nil, nil, "LOGIN", imapString(user), imapString(pass))
+	return err
+}
+
+// Logout ends the IMAP session
+func (c *imapConn) Logout() error {
+	_, err := c.execute(nil, nil, "LOGOUT")
+	return err
+}
+
+// StartTLS upgrades the connection to TLS with the STARTTLS command
+func (c *imapConn) StartTLS(config *tls.Config) error {
+	_, err := c.execute(nil, nil, "STARTTLS")
+	if err != nil {
+		return err
+	}
+
+	// anything received before the TLS negotiation could have been injected
+	// into the plaintext connection
+	if c.reader.Buffered() > 0 {
+		c.err = errors.New("unexpected data after STARTTLS")
+		return c.err
+	}
+
+	conn := tls.Client(c.conn, config)
+	err = conn.Handshake()
+	if err != nil {
+		c.err = err
+		return err
+	}
+
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.writer = bufio.NewWriter(conn)
+	return nil
+}
+
+// Noop does nothing, it can be used to check that the session is alive
+func (c *imapConn) Noop() error {
+	_, err := c.execute(nil, nil, "NOOP")
+	return err
+}
+
+// Close closes the connection to the IMAP server
+func (c *imapConn) Close() error {
+	return c.conn.Close()
+}
+
+// Status requests the status items of mailbox, e.g. (MESSAGES UIDNEXT), and
+// returns their values
+func (c *imapConn) Status(mailbox, items string) (map[string]int, error) {
+	status := make(map[string]int)
+
+	untagged := func(line string) error {
+		fields := imapFields(line)
+		if len(fields) < 3 || strings.ToUpper(fields[0]) != "STATUS" {
+			return nil
+		}
+
+		list := fields[len(fields)-1]
+		if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+			return nil
+		}
+
+		values := imapFields(list[1 : len(list)-1])
+		for i := 0; i+1 < len(values); i += 2 {
+			status[strings.ToUpper(values[i])], _ = strconv.Atoi(values[i+1])
+		}
+		return nil
+	}
+
+	_, err := c.execute(untagged, nil, "STATUS", imapString(mailbox), items)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Create creates mailbox
+func (c *imapConn) Create(mailbox string) error {
+	_, err := c.execute(nil, nil, "CREATE", imapString(mailbox))
+	return err
+}
+
+// Subscribe subscribes to mailbox
+func (c *imapConn) Subscribe(mailbox string) error {
+	_, err := c.execute(nil, nil, "SUBSCRIBE", imapString(mailbox))
+	return err
+}
+
+// Select selects mailbox and returns the number of messages and the
+// UIDVALIDITY of the mailbox
+func (c *imapConn) Select(mailbox string) (*mailboxStatus, error) {
+	status := &mailboxStatus{}
+
+	untagged := func(line string) error {
+		fields := imapFields(line)
+		switch {
+		case len(fields) >= 2 && strings.ToUpper(fields[1]) == "EXISTS":
+			status.Exists, _ = strconv.Atoi(fields[0])
+		case len(fields) >= 2 && strings.ToUpper(fields[0]) == "OK" && strings.HasPrefix(strings.ToUpper(fields[1]), "[UIDVALIDITY "):
+			code := strings.TrimSuffix(fields[1][len("[UIDVALIDITY "):], "]")
+			validity, _ := strconv.ParseUint(code, 10, 32)
+			status.UIDValidity = uint32(validity)
+		}
+		return nil
+	}
+
+	_, err := c.execute(untagged, nil, "SELECT", imapString(mailbox))
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Search searches the selected mailbox and returns the matching message
+// sequence numbers
+func (c *imapConn) Search(criteria ...interface{}) ([]string, error) {
+	return c.search("SEARCH", criteria)
+}
+
+// UIDSearch searches the selected mailbox and returns the matching UIDs
+func (c *imapConn) UIDSearch(criteria ...interface{}) ([]string, error) {
+	return c.search("UID SEARCH", criteria)
+}
+
+func (c *imapConn) search(cmd string, criteria []interface{}) ([]string, error) {
+	ids := []string{}
+
+	untagged := func(line string) error {
+		fields := imapFields(line)
+		if len(fields) > 0 && strings.ToUpper(fields[0]) == "SEARCH" {
+			ids = append(ids, fields[1:]...)
+		}
+		return nil
+	}
+
+	_, err := c.execute(untagged, nil, append([]interface{}{cmd}, criteria...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// Copy copies the messages in set to mailbox
+func (c *imapConn) Copy(set, mailbox string) error {
+	_, err := c.execute(nil, nil, "COPY", set, imapString(mailbox))
+	return err
+}
+
+// UIDCopy copies the messages with the UIDs in set to mailbox
+func (c *imapConn) UIDCopy(set, mailbox string) error {
+	_, err := c.execute(nil, nil, "UID COPY", set, imapString(mailbox))
+	return err
+}
+
+// StoreAddFlag adds flag to the messages in set
+func (c *imapConn) StoreAddFlag(set, flag string) error {
+	_, err := c.execute(nil, nil, "STORE", set, "+FLAGS.SILENT", "("+flag+")")
+	return err
+}
+
+// UIDStoreAddFlag adds flag to the messages with the UIDs in set
+func (c *imapConn) UIDStoreAddFlag(set, flag string) error {
+	_, err := c.execute(nil, nil, "UID STORE", set, "+FLAGS.SILENT", "("+flag+")")
+	return err
+}
+
+// Expunge permanently removes the messages marked as \Deleted from the
+// selected mailbox
+func (c *imapConn) Expunge() error {
+	_, err := c.execute(nil, nil, "EXPUNGE")
+	return err
+}
+
+// UIDExpunge permanently removes the messages with the UIDs in set if they are
+// marked as \Deleted, leaving other deleted messages alone (UIDPLUS, RFC 4315)
+func (c *imapConn) UIDExpunge(set string) error {
+	_, err := c.execute(nil, nil, "UID EXPUNGE", set)
+	return err
+}
+
+// Fetch fetches data items of the messages in set. If literal is not nil it
+// is used to handle the literals of the responses instead of buffering them.
+func (c *imapConn) Fetch(set, items string, literal literalFunc) ([]*fetchResponse, error) {
+	return c.fetch("FETCH", set, items, literal)
+}
+
+// UIDFetch is like Fetch but set contains UIDs instead of message sequence
+// numbers
+func (c *imapConn) UIDFetch(set, items string, literal literalFunc) ([]*fetchResponse, error) {
+	return c.fetch("UID FETCH", set, items, literal)
+}
+
+func (c *imapConn) fetch(cmd, set, items string, literal literalFunc) ([]*fetchResponse, error) {
+	resps := []*fetchResponse{}
+
+	untagged := func(line string) error {
+		resp, ok := parseFetch(line)
+		if ok {
+			resps = append(resps, resp)
+		}
+		return nil
+	}
+
+	_, err := c.execute(untagged, literal, cmd, set, items)
+	if err != nil {
+		return nil, err
+	}
+
+	return resps, nil
+}
+
+// execute sends a command built from args and reads the responses until the
+// command is completed. Untagged responses are passed to untagged, and
+// literals to literal. Returns the text of the OK completion response.
+func (c *imapConn) execute(untagged func(line string) error, literal literalFunc, args ...interface{}) (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+
+	c.tag++
+	tag := fmt.Sprintf("a%03d", c.tag)
+
+	c.writer.WriteString(tag)
+	for _, arg := range args {
+		c.writer.WriteString(" ")
+
+		switch a := arg.(type) {
+		case imapLiteral:
+			fmt.Fprintf(c.writer, "{%d}\r\n", len(a))
+			err := c.waitContinuation(untagged)
+			if err != nil {
+				return "", err
+			}
+			c.writer.WriteString(string(a))
+		default:
+			fmt.Fprint(c.writer, a)
+		}
+	}
+	c.writer.WriteString("\r\n")
+
+	err := c.flush()
+	if err != nil {
+		return "", err
+	}
+
+	// errors from the handlers are returned once the command is completed
+	// so the connection is not left in the middle of a response
+	var handlerErr error
+	if literal != nil {
+		handle := literal
+		literal = func(prefix string, size int64, r io.Reader) (string, error) {
+			if handlerErr != nil {
+				return "NIL", nil
+			}
+			text, err := handle(prefix, size, r)
+			if err != nil {
+				handlerErr = err
+				return "NIL", nil
+			}
+			return text, nil
+		}
+	}
+
+	for {
+		line, err := c.readResponse(literal)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case strings.HasPrefix(line, "* "):
+			if untagged != nil && handlerErr == nil {
+				handlerErr = untagged(line[2:])
+			}
+		case strings.HasPrefix(line, tag+" "):
+			status, text := splitStatus(line[len(tag)+1:])
+			if status != "OK" {
+				return "", &imapError{status, text}
+			}
+			return text, handlerErr
+		}
+	}
+}
+
+// flush the pending command and wait for the server to ask for the literal
+func (c *imapConn) waitContinuation(untagged func(line string) error) error {
+	err := c.flush()
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := c.readResponse(nil)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case strings.HasPrefix(line, "+"):
+			return nil
+		case strings.HasPrefix(line, "* "):
+			if untagged != nil {
+				untagged(line[2:])
+			}
+		default:
+			status, text := splitStatus(line[strings.Index(line, " ")+1:])
+			return &imapError{status, text}
+		}
+	}
+}
+
+// flush the buffered command to the server
+func (c *imapConn) flush() error {
+	err := c.writer.Flush()
+	if err != nil {
+		c.err = err
+	}
+	return err
+}
+
+// readResponse reads a complete server response. A response containing
+// literals spans several lines, the literals are passed to literal or, if it
+// is nil, included in the response as quoted strings.
+func (c *imapConn) readResponse(literal literalFunc) (string, error) {
+	resp, err := c.readLines(literal)
+	if err != nil {
+		c.err = err
+	}
+	return resp, err
+}
+
+func (c *imapConn) readLines(literal literalFunc) (string, error) {
+	var resp string
+
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		prefix, size, ok := splitLiteral(line)
+		if !ok {
+			return resp + line, nil
+		}
+		resp += prefix
+
+		r := io.LimitReader(c.reader, size)
+
+		var text string
+		if literal != nil {
+			text, err = literal(resp, size, r)
+		} else {
+			text, err = readLiteral(r)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// discard the part of the literal not read by the handler
+		_, err = io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return "", err
+		}
+
+		resp += text
+	}
+}
+
+// read a literal and return it as a quoted string
+func readLiteral(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return quote(string(data)), nil
+}
+
+// split a line ending with a literal size {n} into the line before the
+// literal and the size
+func splitLiteral(line string) (string, int64, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return "", 0, false
+	}
+
+	idx := strings.LastIndex(line, "{")
+	if idx < 0 {
+		return "", 0, false
+	}
+
+	size, err := strconv.ParseInt(line[idx+1:len(line)-1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return line[:idx], size, true
+}
+
+// split a completion response into status and text
+func splitStatus(resp string) (string, string) {
+	fields := strings.SplitN(resp, " ", 2)
+	if len(fields) < 2 {
+		return strings.ToUpper(fields[0]), ""
+	}
+	return strings.ToUpper(fields[0]), fields[1]
+}
+
+// parse an untagged FETCH response
+func parseFetch(line string) (*fetchResponse, bool) {
+	fields := imapFields(line)
+	if len(fields) < 3 || strings.ToUpper(fields[1]) != "FETCH" {
+		return nil, false
+	}
+
+	seq, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, false
+	}
+
+	list := fields[2]
+	if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+		return nil, false
+	}
+
+	resp := &fetchResponse{
+		Seq:   seq,
+		Items: make(map[string]string),
+	}
+
+	items := imapFields(list[1 : len(list)-1])
+	for i := 0; i+1 < len(items); i += 2 {
+		resp.Items[strings.ToUpper(items[i])] = items[i+1]
+	}
+
+	return resp, true
+}
+
+// imapFields splits a response into fields. Quoted strings are unquoted while
+// parenthesized lists and bracketed sections like BODY[HEADER.FIELDS (FROM)]
+// are kept as single fields.
+func imapFields(s string) []string {
+	fields := []string{}
+
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case ' ':
+			i++
+		case '"':
+			field, n := unquote(s[i:])
+			fields = append(fields, field)
+			i += n
+		case '(':
+			n := matching(s[i:], '(', ')')
+			fields = append(fields, s[i:i+n])
+			i += n
+		default:
+			start := i
+			for i < len(s) && s[i] != ' ' && s[i] != '(' && s[i] != ')' {
+				if s[i] == '[' {
+					i += matching(s[i:], '[', ']')
+					continue
+				}
+				i++
+			}
+			if i == start {
+				// stray closing parenthesis
+				i++
+				continue
+			}
+			fields = append(fields, s[start:i])
+		}
+	}
+
+	return fields
+}
+
+// get the length of the prefix of s up to and including the bracket matching
+// the opening bracket at s[0]. Quoted strings are skipped.
+func matching(s string, open, close byte) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			_, n := unquote(s[i:])
+			i += n - 1
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(s)
+}
+
+// unquote the quoted string at the beginning of s. Returns the unquoted string
+// and the length of the quoted string in s.
+func unquote(s string) (string, int) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), i + 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), len(s)
+}
+
+// quote s as a quoted string
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// imapString returns s as a command argument. s is sent as a quoted string
+// unless it contains characters which are not allowed in quoted strings, in
+// which case it is sent as a literal.
+func imapString(s string) interface{} {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\r' || s[i] == '\n' || s[i] == 0 || s[i] >= 0x80 {
+			return imapLiteral(s)
+		}
+	}
+	return quote(s)
+}
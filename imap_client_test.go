@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeIMAPServer sets up a client connected to a fake IMAP server which
+// answers the n'th command with responses[n], where %s is replaced by the
+// tag of the command. Literals sent by the client are accepted with a
+// continuation request. The complete commands are sent on the returned
+// channel.
+func fakeIMAPServer(t *testing.T, responses ...string) (*imapConn, <-chan string) {
+	client, server := net.Pipe()
+	commands := make(chan string, len(responses))
+
+	go func() {
+		defer server.Close()
+		defer close(commands)
+
+		r := bufio.NewReader(server)
+		io.WriteString(server, "* OK fake IMAP server ready\r\n")
+
+		for _, resp := range responses {
+			cmd, err := readFakeCommand(r, server)
+			if err != nil {
+				return
+			}
+			commands <- cmd
+
+			tag := strings.Fields(cmd)[0]
+			_, err = io.WriteString(server, fmt.Sprintf(resp, tag))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := newIMAPConn(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, commands
+}
+
+// read a command line, including any literals, from r
+func readFakeCommand(r *bufio.Reader, w io.Writer) (string, error) {
+	var cmd string
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		cmd += line
+
+		prefix, size, ok := splitLiteral(strings.TrimRight(line, "\r\n"))
+		if !ok {
+			return strings.TrimRight(cmd, "\r\n"), nil
+		}
+		cmd = cmd[:len(cmd)-len(line)] + prefix
+
+		io.WriteString(w, "+ go ahead\r\n")
+
+		literal := make([]byte, size)
+		_, err = io.ReadFull(r, literal)
+		if err != nil {
+			return "", err
+		}
+		cmd += quote(string(literal))
+	}
+}
+
+func TestIMAPFields(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []string
+	}{
+		{`SEARCH 1 2 3`, []string{"SEARCH", "1", "2", "3"}},
+		{`OK [UIDVALIDITY 42] UIDs valid`, []string{"OK", "[UIDVALIDITY 42]", "UIDs", "valid"}},
+		{`"quoted \"string\"" "back\\slash" ""`, []string{`quoted "string"`, `back\slash`, ""}},
+		{`1 FETCH (UID 7 FLAGS (\Seen \Deleted))`, []string{"1", "FETCH", `(UID 7 FLAGS (\Seen \Deleted))`}},
+		{`(a (b (c) ")") d) e`, []string{`(a (b (c) ")") d)`, "e"}},
+		{`BODY[HEADER.FIELDS (FROM TO)] "x"`, []string{"BODY[HEADER.FIELDS (FROM TO)]", "x"}},
+		{`BODY[TEXT]<0> NIL`, []string{"BODY[TEXT]<0>", "NIL"}},
+		{`  spaced   out  `, []string{"spaced", "out"}},
+		{`stray ) paren`, []string{"stray", "paren"}},
+	}
+
+	for _, test := range tests {
+		out := imapFields(test.in)
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("imapFields(%q) = %q, expected %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestSplitLiteral(t *testing.T) {
+	tests := []struct {
+		in     string
+		prefix string
+		size   int64
+		ok     bool
+	}{
+		{`* 1 FETCH (RFC822 {42}`, `* 1 FETCH (RFC822 `, 42, true},
+		{`* 1 FETCH (BODY[HEADER] {0}`, `* 1 FETCH (BODY[HEADER] `, 0, true},
+		{`* OK {not a literal}`, "", 0, false},
+		{`* 1 FETCH (UID 7)`, "", 0, false},
+		{`}`, "", 0, false},
+	}
+
+	for _, test := range tests {
+		prefix, size, ok := splitLiteral(test.in)
+		if prefix != test.prefix || size != test.size || ok != test.ok {
+			t.Errorf("splitLiteral(%q) = %q, %d, %t, expected %q, %d, %t",
+				test.in, prefix, size, ok, test.prefix, test.size, test.ok)
+		}
+	}
+}
+
+func TestParseFetch(t *testing.T) {
+	tests := []struct {
+		in   string
+		resp *fetchResponse
+	}{
+		{
+			`12 FETCH (UID 7 RFC822.SIZE 1024)`,
+			&fetchResponse{12, map[string]string{"UID": "7", "RFC822.SIZE": "1024"}},
+		},
+		{
+			`1 FETCH (FLAGS (\Seen) UID 3)`,
+			&fetchResponse{1, map[string]string{"FLAGS": `(\Seen)`, "UID": "3"}},
+		},
+		{
+			// literals are replaced by quoted strings by readLiteral
+			`2 fetch (uid 9 BODY[HEADER.FIELDS (MESSAGE-ID)] ` + quote("Message-ID: <a@\"b\">\r\n") + `)`,
+			&fetchResponse{2, map[string]string{"UID": "9", "BODY[HEADER.FIELDS (MESSAGE-ID)]": "Message-ID: <a@\"b\">\r\n"}},
+		},
+		{`3 EXISTS`, nil},
+		{`x FETCH (UID 1)`, nil},
+		{`1 FETCH UID`, nil},
+	}
+
+	for _, test := range tests {
+		resp, ok := parseFetch(test.in)
+		if ok != (test.resp != nil) || (ok && !reflect.DeepEqual(resp, test.resp)) {
+			t.Errorf("parseFetch(%q) = %v, %t, expected %v", test.in, resp, ok, test.resp)
+		}
+	}
+}
+
+func TestIMAPString(t *testing.T) {
+	tests := []struct {
+		in  string
+		out interface{}
+	}{
+		{"user", `"user"`},
+		{`pa"ss\word`, `"pa\"ss\\word"`},
+		{"line\r\nbreak", imapLiteral("line\r\nbreak")},
+		{"blåbær", imapLiteral("blåbær")},
+	}
+
+	for _, test := range tests {
+		out := imapString(test.in)
+		if out != test.out {
+			t.Errorf("imapString(%q) = %#v, expected %#v", test.in, out, test.out)
+		}
+
+		// quoted strings must survive a round trip
+		if s, ok := out.(string); ok {
+			unquoted, n := unquote(s)
+			if unquoted != test.in || n != len(s) {
+				t.Errorf("unquote(%q) = %q, %d", s, unquoted, n)
+			}
+		}
+	}
+}
+
+func TestIMAPLiteralCommand(t *testing.T) {
+	c, commands := fakeIMAPServer(t, "%s OK logged in\r\n")
+
+	err := c.Login("user", "blåbær")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := <-commands
+	if cmd != `a001 LOGIN "user" "blåbær"` {
+		t.Errorf("unexpected command %q", cmd)
+	}
+}
+
+func TestIMAPError(t *testing.T) {
+	c, _ := fakeIMAPServer(t, "%s NO [AUTHENTICATIONFAILED] invalid credentials\r\n")
+
+	err := c.Login("user", "pass")
+	ierr, ok := err.(*imapError)
+	if !ok || ierr.Status != "NO" || ierr.Text != "[AUTHENTICATIONFAILED] invalid credentials" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	if c.err != nil {
+		t.Errorf("connection marked as broken by a NO response: %s", c.err)
+	}
+}
+
+func TestIMAPSelect(t *testing.T) {
+	c, _ := fakeIMAPServer(t, "* FLAGS (\\Seen \\Deleted)\r\n"+
+		"* 172 EXISTS\r\n"+
+		"* 1 RECENT\r\n"+
+		"* OK [UIDVALIDITY 3857529045] UIDs valid\r\n"+
+		"* OK [UIDNEXT 4392] Predicted next UID\r\n"+
+		"%s OK [READ-WRITE] SELECT completed\r\n")
+
+	status, err := c.Select("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Exists != 172 || status.UIDValidity != 3857529045 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestIMAPStatus(t *testing.T) {
+	c, _ := fakeIMAPServer(t, "* STATUS \"INBOX/alumni\" (MESSAGES 17 UIDNEXT 42)\r\n"+
+		"%s OK STATUS completed\r\n")
+
+	status, err := c.Status("INBOX/alumni", "(MESSAGES UIDNEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{"MESSAGES": 17, "UIDNEXT": 42}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("unexpected status %v", status)
+	}
+}
+
+func TestIMAPFetchLiterals(t *testing.T) {
+	header := "From: a@b\r\nTo: c@d\r\n\r\n"
+	text := "body (with parens) and \"quotes\"\r\n"
+
+	c, _ := fakeIMAPServer(t, fmt.Sprintf("* 1 FETCH (UID 5 BODY[HEADER] {%d}\r\n%s BODY[TEXT] {%d}\r\n%s)\r\n",
+		len(header), header, len(text), text)+"%s OK FETCH completed\r\n")
+
+	resps, err := c.Fetch("1", "(UID BODY.PEEK[HEADER] BODY.PEEK[TEXT])", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resps) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(resps))
+	}
+
+	resp := resps[0]
+	if resp.Int("UID") != 5 || resp.Items["BODY[HEADER]"] != header || resp.Items["BODY[TEXT]"] != text {
+		t.Errorf("unexpected response %q", resp.Items)
+	}
+}
+
+func TestIMAPFetchUnsolicited(t *testing.T) {
+	msg := "Subject: hi\r\n\r\n.line\r\n"
+
+	// unsolicited responses interleaved with the requested message
+	c, _ := fakeIMAPServer(t, "* 3 EXISTS\r\n"+
+		"* 1 FETCH (FLAGS (\\Seen))\r\n"+
+		"* 2 FETCH (BODY[HEADER] {2}\r\n\r\n)\r\n"+
+		fmt.Sprintf("* 2 FETCH (UID 9 RFC822 {%d}\r\n%s)\r\n", len(msg), msg)+
+		"* 3 FETCH (FLAGS (\\Recent))\r\n"+
+		"%s OK FETCH completed\r\n")
+
+	k := &KUmail{client: c, uids: []string{"9"}}
+
+	var got string
+	calls := 0
+	err := k.Fetch(1, func(r io.Reader) error {
+		calls++
+		data, err := ioutil.ReadAll(r)
+		got = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 1 || got != msg {
+		t.Errorf("got %d calls with %q, expected 1 call with %q", calls, got, msg)
+	}
+}
+
+func TestIMAPFetchMissing(t *testing.T) {
+	c, _ := fakeIMAPServer(t, "* 1 FETCH (FLAGS (\\Seen))\r\n%s OK FETCH completed\r\n")
+
+	k := &KUmail{client: c, uids: []string{"9"}}
+
+	err := k.Fetch(1, func(r io.Reader) error {
+		t.Error("unexpected message")
+		return nil
+	})
+	if err != errNoSuchMessage {
+		t.Errorf("expected errNoSuchMessage, got %v", err)
+	}
+}
+
+func TestIMAPFetchHandlerError(t *testing.T) {
+	msg := "Subject: hi\r\n\r\nbody\r\n"
+
+	c, _ := fakeIMAPServer(t,
+		fmt.Sprintf("* 1 FETCH (UID 9 RFC822 {%d}\r\n%s)\r\n", len(msg), msg)+"%s OK FETCH completed\r\n",
+		"%s OK NOOP completed\r\n")
+
+	k := &KUmail{client: c, uids: []string{"9"}}
+
+	// the handler fails after reading part of the literal
+	errClient := fmt.Errorf("client went away")
+	err := k.Fetch(1, func(r io.Reader) error {
+		r.Read(make([]byte, 4))
+		return errClient
+	})
+	if err != errClient {
+		t.Fatalf("expected handler error, got %v", err)
+	}
+
+	// the rest of the response has been consumed, so the connection is
+	// still usable
+	err = c.Noop()
+	if err != nil {
+		t.Errorf("connection unusable after handler error: %s", err)
+	}
+}
+
+func TestIMAPMessageIDUniqueIDs(t *testing.T) {
+	Conf = &ServerConfig{IMAP: imapClient{UIDL: uidlMessageID}}
+
+	header := "Message-ID:\r\n <a@b>\r\n\r\n"
+	c, commands := fakeIMAPServer(t,
+		fmt.Sprintf("* 1 FETCH (UID 7 BODY[HEADER.FIELDS (MESSAGE-ID)] {%d}\r\n%s)\r\n", len(header), header)+
+			"* 2 FETCH (UID 8 BODY[HEADER.FIELDS (MESSAGE-ID)] {2}\r\n\r\n)\r\n"+
+			fmt.Sprintf("* 3 FETCH (UID 9 BODY[HEADER.FIELDS (MESSAGE-ID)] {%d}\r\n%s)\r\n", len(header), header)+
+			"%s OK FETCH completed\r\n")
+
+	k := &KUmail{client: c, uids: []string{"7", "8", "9"}, uidValidity: 42}
+
+	uidls, err := k.uniqueIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := <-commands
+	if cmd != "a001 FETCH 1:* (UID BODY.PEEK[HEADER.FIELDS (MESSAGE-ID)])" {
+		t.Errorf("unexpected command %q", cmd)
+	}
+
+	// sha1 of "<a@b>", later copies are told apart by their UID
+	hash := "81da381b1c657a50d04e3189a487237dfe3f6162"
+	expected := []string{hash, "42.8", hash + ".42.9"}
+	if !reflect.DeepEqual(uidls, expected) {
+		t.Errorf("uniqueIDs() = %q, expected %q", uidls, expected)
+	}
+}
+
+// fakeIMAPFolder starts an IMAP server on a local listener serving a folder
+// of n messages. Every FETCH command received is counted in fetches.
+func fakeIMAPFolder(tb testing.TB, n int, fetches *int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var listing bytes.Buffer
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&listing, "* %d FETCH (UID %d RFC822.SIZE %d)\r\n", i, i+100, 1000+i)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				w := bufio.NewWriter(conn)
+				io.WriteString(w, "* OK fake IMAP server ready\r\n")
+				w.Flush()
+
+				for {
+					cmd, err := readFakeCommand(r, conn)
+					if err != nil {
+						return
+					}
+
+					fields := strings.Fields(cmd)
+					switch strings.ToUpper(fields[1]) {
+					case "SELECT":
+						fmt.Fprintf(w, "* %d EXISTS\r\n* OK [UIDVALIDITY 42] UIDs valid\r\n", n)
+					case "FETCH":
+						atomic.AddInt64(fetches, 1)
+						w.Write(listing.Bytes())
+					}
+					fmt.Fprintf(w, "%s OK %s completed\r\n", fields[0], fields[1])
+					w.Flush()
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+// BenchmarkSnapshot measures listing a folder of 5000 messages, which takes a
+// single FETCH round trip
+func BenchmarkSnapshot(b *testing.B) {
+	Conf = &ServerConfig{IMAP: imapClient{Folder: "alumni"}}
+
+	var fetches int64
+	l := fakeIMAPFolder(b, 5000, &fetches)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	c, err := newIMAPConn(conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.conn.Close()
+
+	k := &KUmail{client: c}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = k.snapshot()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	if len(k.uids) != 5000 || k.uids[4999] != "5100" || k.sizes[0] != 1001 {
+		b.Fatalf("unexpected snapshot of %d messages", len(k.uids))
+	}
+
+	n := atomic.LoadInt64(&fetches)
+	if n != int64(b.N) {
+		b.Fatalf("%d FETCH commands for %d snapshots", n, b.N)
+	}
+	b.ReportMetric(float64(n)/float64(b.N), "fetches/op")
+}
+
+func TestIMAPTopHugeLineCount(t *testing.T) {
+	header := "Subject: hi\r\n\r\n"
+	text := "line 1\r\nline 2"
+
+	c, commands := fakeIMAPServer(t,
+		fmt.Sprintf("* 1 FETCH (UID 9 BODY[HEADER] {%d}\r\n%s)\r\n", len(header), header)+"%s OK FETCH completed\r\n",
+		fmt.Sprintf("* 1 FETCH (UID 9 BODY[TEXT]<0> {%d}\r\n%s)\r\n", len(text), text)+"%s OK FETCH completed\r\n")
+
+	k := &KUmail{client: c, uids: []string{"9"}, sizes: []int{29}}
+
+	top, err := k.Top(1, 100000000000000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if top != header+text {
+		t.Errorf("unexpected TOP %q", top)
+	}
+
+	<-commands
+	cmd := <-commands
+	if cmd != "a002 UID FETCH 9 BODY.PEEK[TEXT]<0.29>" {
+		t.Errorf("partial fetch not limited to the message size: %q", cmd)
+	}
+}
+
+func TestIMAPDeleteExpungesOnlyDeleted(t *testing.T) {
+	Conf = &ServerConfig{}
+
+	c, commands := fakeIMAPServer(t,
+		"%s OK STORE completed\r\n",
+		"%s OK STORE completed\r\n",
+		"* 1 EXPUNGE\r\n* 2 EXPUNGE\r\n%s OK EXPUNGE completed\r\n")
+
+	k := &KUmail{client: c, uids: []string{"7", "8", "9"}, settings: &Settings{}}
+
+	err := k.Delete([]int{1, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`a001 UID STORE 7 +FLAGS.SILENT (\Deleted)`,
+		`a002 UID STORE 9 +FLAGS.SILENT (\Deleted)`,
+		"a003 UID EXPUNGE 7,9",
+	}
+	for _, e := range expected {
+		if cmd := <-commands; cmd != e {
+			t.Errorf("unexpected command %q, expected %q", cmd, e)
+		}
+	}
+}
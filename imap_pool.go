@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// imapSessions global pool of authenticated IMAP sessions
+var imapSessions *imapPool
+
+// default time an IMAP session is kept in the pool
+const defaultPoolIdle = 5 * time.Minute
+
+// imapSession is an authenticated IMAP session kept in the pool between POP3
+// sessions of the same user
+type imapSession struct {
+	client *imapConn
+	// settings the session was set up with
+	settings Settings
+	// status of INBOX when the mails were organized
+	inbox    map[string]int
+	lastUsed time.Time
+}
+
+// imapPool keeps a bounded number of idle IMAP sessions, at most one per user.
+// A session is removed from the pool while it is in use. A nil pool keeps no
+// sessions.
+type imapPool struct {
+	sync.Mutex
+	size     int
+	idle     time.Duration
+	sessions map[string]*imapSession
+	closed   bool
+}
+
+// newIMAPPool creates a pool holding at most size sessions, which are logged
+// out when they have been idle for longer than idle. Returns nil if size is 0.
+func newIMAPPool(size int, idle time.Duration) *imapPool {
+	if size <= 0 {
+		return nil
+	}
+
+	if idle <= 0 {
+		idle = defaultPoolIdle
+	}
+
+	p := &imapPool{
+		size:     size,
+		idle:     idle,
+		sessions: make(map[string]*imapSession),
+	}
+
+	go p.expire()
+
+	return p
+}
+
+// Get takes the session of user out of the pool if pass is verified by the
+// credential cache, so sessions are reused under the same policy as cached
+// logins. Returns nil if there is no such session.
+func (p *imapPool) Get(user, pass string) *imapSession {
+	if p == nil {
+		return nil
+	}
+
+	p.Lock()
+	s, ok := p.sessions[user]
+	if ok {
+		delete(p.sessions, user)
+	}
+	p.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if time.Since(s.lastUsed) > p.idle || !authCache.Verify(user, pass) {
+		logoutIMAP(s.client)
+		return nil
+	}
+
+	// make sure the session is still alive
+	err := s.client.Noop()
+	if err != nil {
+		s.client.Close()
+		return nil
+	}
+
+	return s
+}
+
+// Put returns the session of user to the pool. The least recently used
+// session is logged out if the pool is full.
+func (p *imapPool) Put(user string, s *imapSession) {
+	// sessions with a broken connection can't be reused
+	if p == nil || s.client.err != nil {
+		logoutIMAP(s.client)
+		return
+	}
+
+	s.lastUsed = time.Now()
+
+	var evicted []*imapSession
+
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		logoutIMAP(s.client)
+		return
+	}
+
+	if old, ok := p.sessions[user]; ok {
+		evicted = append(evicted, old)
+		delete(p.sessions, user)
+	}
+
+	if len(p.sessions) >= p.size {
+		var oldest string
+		for u, session := range p.sessions {
+			if oldest == "" || session.lastUsed.Before(p.sessions[oldest].lastUsed) {
+				oldest = u
+			}
+		}
+		evicted = append(evicted, p.sessions[oldest])
+		delete(p.sessions, oldest)
+	}
+
+	p.sessions[user] = s
+	p.Unlock()
+
+	for _, session := range evicted {
+		logoutIMAP(session.client)
+	}
+}
+
+// Close logs out of all sessions in the pool. Sessions returned to the pool
+// afterwards are logged out right away.
+func (p *imapPool) Close() {
+	if p == nil {
+		return
+	}
+
+	p.Lock()
+	sessions := p.sessions
+	p.sessions = make(map[string]*imapSession)
+	p.closed = true
+	p.Unlock()
+
+	for _, s := range sessions {
+		logoutIMAP(s.client)
+	}
+}
+
+// expire logs out sessions which have been idle for too long
+func (p *imapPool) expire() {
+	ticker := time.NewTicker(time.Minute)
+
+	for range ticker.C {
+		var expired []*imapSession
+
+		p.Lock()
+		for user, s := range p.sessions {
+			if time.Since(s.lastUsed) > p.idle {
+				expired = append(expired, s)
+				delete(p.sessions, user)
+			}
+		}
+		p.Unlock()
+
+		for _, s := range expired {
+			logoutIMAP(s.client)
+		}
+	}
+}
+
+// logout of the IMAP session and close the connection
+func logoutIMAP(client *imapConn) {
+	client.Logout()
+	client.Close()
+}
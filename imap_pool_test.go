@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIMAPPoolVerifiesCredentials(t *testing.T) {
+	Conf = &ServerConfig{Login: loginLimit{CacheTTL: 300}}
+	authCache = &credentialCache{entries: make(map[string]*credential)}
+	authCache.Store("user", "secret")
+
+	p := &imapPool{size: 1, idle: time.Minute, sessions: make(map[string]*imapSession)}
+
+	// a session is only reused with the cached password
+	c, _ := fakeIMAPServer(t, "* BYE logging out\r\n%s OK LOGOUT completed\r\n")
+	p.Put("user", &imapSession{client: c})
+	if p.Get("user", "wrong") != nil {
+		t.Error("session reused with a wrong password")
+	}
+	if len(p.sessions) != 0 {
+		t.Error("session kept after a wrong password")
+	}
+
+	c, _ = fakeIMAPServer(t, "%s OK NOOP completed\r\n")
+	p.Put("user", &imapSession{client: c})
+	if p.Get("user", "secret") == nil {
+		t.Error("session not reused with the cached password")
+	}
+
+	// without the password cached sessions aren't reused
+	authCache.Forget("user")
+	c, _ = fakeIMAPServer(t, "* BYE logging out\r\n%s OK LOGOUT completed\r\n")
+	p.Put("user", &imapSession{client: c})
+	if p.Get("user", "secret") != nil {
+		t.Error("session reused without a cached password")
+	}
+}
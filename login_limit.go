@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// default limits on failed logins
+const (
+	defaultMaxFailures    = 10
+	defaultMaxFailedUsers = 50
+	defaultLockout        = 15 * time.Minute
+	// the delay after the first failed login, doubled for every failure
+	loginBackoff    = time.Second
+	maxLoginBackoff = time.Minute
+)
+
+// loginLimits global limiter shared by the POP3 server and the web interface
+var loginLimits = newLoginLimiter()
+
+// loginFailures holds the failed logins of an IP address or a username
+type loginFailures struct {
+	count int
+	last  time.Time
+	// no logins are allowed before blocked
+	blocked time.Time
+	// distinct usernames which failed to log in from an IP address
+	users map[string]bool
+}
+
+// loginLimiter protects against password guessing by counting failed logins
+// per username and the usernames failing per IP address. After every failure
+// further logins for the username are refused for an exponentially growing
+// delay, and after too many failures the username is locked out for a while.
+// An IP address is only locked out when logins fail for many different
+// usernames, as clients like Gmail fetch the mail of all their users from a
+// few shared addresses, and some users will have stale passwords.
+type loginLimiter struct {
+	sync.Mutex
+	failures map[string]*loginFailures
+}
+
+func newLoginLimiter() *loginLimiter {
+	l := &loginLimiter{failures: make(map[string]*loginFailures)}
+	go l.expire()
+	return l
+}
+
+// Allowed returns true if a login for user from ip may be attempted
+func (l *loginLimiter) Allowed(ip, user string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for _, key := range []string{"ip " + ip, "user " + user} {
+		f, ok := l.failures[key]
+		if ok && now.Before(f.blocked) {
+			Log.Warningf("refusing login for %s from %s: %s blocked for %s", user, ip, key, f.blocked.Sub(now))
+			return false
+		}
+	}
+
+	return true
+}
+
+// Failed records a failed login for user from ip
+func (l *loginLimiter) Failed(ip, user string) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+
+	f := l.get("user "+user, now)
+	f.count++
+	f.last = now
+
+	if f.count >= maxFailures() {
+		f.blocked = now.Add(lockout())
+		Log.Warningf("locking out user %s for %s after %d failed logins", user, lockout(), f.count)
+	} else {
+		delay := loginBackoff << uint(f.count-1)
+		if delay > maxLoginBackoff || delay <= 0 {
+			delay = maxLoginBackoff
+		}
+		f.blocked = now.Add(delay)
+	}
+
+	f = l.get("ip "+ip, now)
+	if f.users == nil {
+		f.users = make(map[string]bool)
+	}
+	f.users[user] = true
+	f.last = now
+
+	if len(f.users) >= maxFailedUsers() {
+		f.blocked = now.Add(lockout())
+		Log.Warningf("locking out ip %s for %s after failed logins for %d users", ip, lockout(), len(f.users))
+	}
+}
+
+// get the failures of key, starting over if the last failure is older than the
+// lockout period
+func (l *loginLimiter) get(key string, now time.Time) *loginFailures {
+	f, ok := l.failures[key]
+	if !ok || now.Sub(f.last) > lockout() {
+		f = &loginFailures{}
+		l.failures[key] = f
+	}
+	return f
+}
+
+// Succeeded clears the failed logins of user. The IP address keeps counting
+// the other usernames failing from it, so logging in to one account doesn't
+// allow guessing the passwords of others.
+func (l *loginLimiter) Succeeded(ip, user string) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.failures, "user "+user)
+	if f, ok := l.failures["ip "+ip]; ok {
+		delete(f.users, user)
+	}
+}
+
+// expire forgets failed logins which are older than the lockout period
+func (l *loginLimiter) expire() {
+	ticker := time.NewTicker(time.Minute)
+
+	for range ticker.C {
+		l.forget(time.Now())
+	}
+}
+
+// forget the failed logins which are older than the lockout period at now
+func (l *loginLimiter) forget(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	for key, f := range l.failures {
+		if now.Sub(f.last) > lockout() && now.After(f.blocked) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// get the number of failed logins before locking out
+func maxFailures() int {
+	if Conf.Login.MaxFailures > 0 {
+		return Conf.Login.MaxFailures
+	}
+	return defaultMaxFailures
+}
+
+// get the number of usernames failing to log in from an IP address before
+// locking out the IP address
+func maxFailedUsers() int {
+	if Conf.Login.MaxFailedUsers > 0 {
+		return Conf.Login.MaxFailedUsers
+	}
+	return defaultMaxFailedUsers
+}
+
+// get the duration of a lockout
+func lockout() time.Duration {
+	if Conf.Login.Lockout > 0 {
+		return time.Duration(Conf.Login.Lockout) * time.Second
+	}
+	return defaultLockout
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testLimiter(conf loginLimit) *loginLimiter {
+	Conf = &ServerConfig{Login: conf}
+	return &loginLimiter{failures: make(map[string]*loginFailures)}
+}
+
+// unblock lets the delay after the last failure of key pass
+func (l *loginLimiter) unblock(key string) {
+	l.failures[key].blocked = time.Now().Add(-time.Second)
+}
+
+func TestLoginBackoff(t *testing.T) {
+	l := testLimiter(loginLimit{})
+
+	if !l.Allowed("10.0.0.1", "user") {
+		t.Fatal("first login refused")
+	}
+
+	for i := 0; i < 8; i++ {
+		l.Failed("10.0.0.1", "user")
+
+		if l.Allowed("10.0.0.2", "user") {
+			t.Fatalf("login allowed right after failure %d", i+1)
+		}
+
+		// the delay doubles for every failure up to the maximum
+		f := l.failures["user user"]
+		delay := f.blocked.Sub(f.last)
+		expected := loginBackoff << uint(i)
+		if expected > maxLoginBackoff {
+			expected = maxLoginBackoff
+		}
+		if delay != expected {
+			t.Errorf("delay after failure %d is %s, expected %s", i+1, delay, expected)
+		}
+
+		l.unblock("user user")
+		if !l.Allowed("10.0.0.1", "user") {
+			t.Fatalf("login refused after the delay of failure %d", i+1)
+		}
+	}
+
+	// other users are not delayed
+	if !l.Allowed("10.0.0.1", "other") {
+		t.Error("login of another user refused")
+	}
+
+	l.Succeeded("10.0.0.1", "user")
+	if _, ok := l.failures["user user"]; ok {
+		t.Error("failures kept after a successful login")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	l := testLimiter(loginLimit{MaxFailures: 3, Lockout: 600})
+
+	for i := 0; i < 3; i++ {
+		l.Failed("10.0.0.1", "user")
+	}
+
+	f := l.failures["user user"]
+	if f.blocked.Sub(f.last) != 10*time.Minute {
+		t.Errorf("locked out for %s, expected 10m", f.blocked.Sub(f.last))
+	}
+	if l.Allowed("10.0.0.1", "user") {
+		t.Error("login allowed during lockout")
+	}
+}
+
+func TestLoginExpiry(t *testing.T) {
+	l := testLimiter(loginLimit{MaxFailures: 3, Lockout: 600})
+
+	l.Failed("10.0.0.1", "user")
+	l.Failed("10.0.0.1", "user")
+
+	// failures older than the lockout period are forgotten
+	l.failures["user user"].last = time.Now().Add(-11 * time.Minute)
+	l.unblock("user user")
+	l.Failed("10.0.0.1", "user")
+	if count := l.failures["user user"].count; count != 1 {
+		t.Errorf("expected old failures to be reset, count is %d", count)
+	}
+
+	l.forget(time.Now().Add(5 * time.Minute))
+	if len(l.failures) != 2 {
+		t.Errorf("recent failures forgotten: %v", l.failures)
+	}
+
+	l.forget(time.Now().Add(11 * time.Minute))
+	if len(l.failures) != 0 {
+		t.Errorf("expired failures kept: %v", l.failures)
+	}
+}
+
+func TestLoginSharedIP(t *testing.T) {
+	l := testLimiter(loginLimit{MaxFailedUsers: 5})
+
+	// a few users with stale passwords polled repeatedly from a shared
+	// address don't block the other users
+	for i := 0; i < 20; i++ {
+		for _, user := range []string{"stale1", "stale2", "stale3"} {
+			l.Failed("10.0.0.1", user)
+		}
+	}
+
+	if !l.Allowed("10.0.0.1", "user") {
+		t.Fatal("login refused from an address shared with users failing to log in")
+	}
+	if l.Allowed("10.0.0.1", "stale1") {
+		t.Error("login allowed for a locked out user")
+	}
+
+	// a user fixing the password is no longer counted
+	l.Succeeded("10.0.0.1", "stale3")
+	l.Failed("10.0.0.1", "user4")
+	if !l.Allowed("10.0.0.1", "user") {
+		t.Error("login refused after a failing user logged in")
+	}
+
+	// guessing the passwords of many users locks out the address
+	for i := 5; i <= 6; i++ {
+		l.Failed("10.0.0.1", fmt.Sprintf("user%d", i))
+	}
+	if l.Allowed("10.0.0.1", "user") {
+		t.Error("login allowed from an address failing for many users")
+	}
+	if !l.Allowed("10.0.0.2", "user") {
+		t.Error("login refused from another address")
+	}
+}
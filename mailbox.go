@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+)
+
+// Mailbox defines a maildrop which can be served by the POP3 server. Messages
+// are numbered from 1 like in POP3. Methods taking a message number return
+// errNoSuchMessage if the number is out of range.
+type Mailbox interface {
+	// List returns the size in octets of every message in the mailbox. The
+	// size of message n is at index n-1.
+	List() ([]int, error)
+	// Size returns the size in octets of message n.
+	Size(n int) (int, error)
+	// UIDs returns the unique-id of every message in the mailbox. The
+	// unique-id of message n is at index n-1.
+	UIDs() ([]string, error)
+	// UID returns the unique-id of message n.
+	UID(n int) (string, error)
+	// Fetch passes the full content of message n to fn. The content is
+	// streamed from r, which is only valid until fn returns.
+	Fetch(n int, fn func(r io.Reader) error) error
+	// Top returns the headers and the first lines of the body of message n.
+	Top(n, lines int) (string, error)
+	// Delete removes the messages with the given numbers from the mailbox.
+	Delete(ns []int) error
+	// Close releases the mailbox.
+	Close() error
+}
+
+// Backend authenticates users and opens their mailbox. Login returns a
+// *LoginError describing the cause if the login fails.
+type Backend interface {
+	Login(user, pass string) (Mailbox, error)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// memMailbox is an in-memory Mailbox used as a fixture in tests
+type memMailbox struct {
+	msgs []string
+	// message numbers passed to Delete
+	deleted []int
+	closed  bool
+}
+
+func newMemMailbox(msgs ...string) *memMailbox {
+	return &memMailbox{msgs: msgs}
+}
+
+func (m *memMailbox) message(n int) (string, error) {
+	if n < 1 || n > len(m.msgs) {
+		return "", errNoSuchMessage
+	}
+	return m.msgs[n-1], nil
+}
+
+func (m *memMailbox) List() ([]int, error) {
+	sizes := make([]int, len(m.msgs))
+	for i, msg := range m.msgs {
+		sizes[i] = len(msg)
+	}
+	return sizes, nil
+}
+
+func (m *memMailbox) Size(n int) (int, error) {
+	msg, err := m.message(n)
+	return len(msg), err
+}
+
+func (m *memMailbox) UIDs() ([]string, error) {
+	uids := make([]string, len(m.msgs))
+	for i := range m.msgs {
+		uids[i] = fmt.Sprintf("uid-%d", i+1)
+	}
+	return uids, nil
+}
+
+func (m *memMailbox) UID(n int) (string, error) {
+	_, err := m.message(n)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("uid-%d", n), nil
+}
+
+func (m *memMailbox) Fetch(n int, fn func(r io.Reader) error) error {
+	msg, err := m.message(n)
+	if err != nil {
+		return err
+	}
+	return fn(strings.NewReader(msg))
+}
+
+func (m *memMailbox) Top(n, lines int) (string, error) {
+	msg, err := m.message(n)
+	if err != nil {
+		return "", err
+	}
+
+	// the header ends with the first empty line
+	end := strings.Index(msg, "\r\n\r\n") + 4
+	if end < 4 {
+		end = strings.Index(msg, "\n\n") + 2
+	}
+	if end < 2 {
+		return msg, nil
+	}
+
+	body, _ := firstLines(msg[end:], lines)
+	return msg[:end] + body, nil
+}
+
+func (m *memMailbox) Delete(ns []int) error {
+	m.deleted = append(m.deleted, ns...)
+	return nil
+}
+
+func (m *memMailbox) Close() error {
+	m.closed = true
+	return nil
+}
+
+// memBackend is a Backend serving a memMailbox to a single user
+type memBackend struct {
+	user    string
+	pass    string
+	mailbox *memMailbox
+	// if set, returned by every login
+	err error
+}
+
+func (b *memBackend) Login(user, pass string) (Mailbox, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if user != b.user || pass != b.pass {
+		return nil, &LoginError{respAuth, errors.New("invalid credentials")}
+	}
+
+	return b.mailbox, nil
+}
+
+func TestMemMailbox(t *testing.T) {
+	var mailbox Mailbox = newMemMailbox(
+		"Subject: one\r\n\r\nline 1\r\nline 2\r\n",
+		"Subject: two\n\nbody\n",
+	)
+
+	sizes, err := mailbox.List()
+	if err != nil || !reflect.DeepEqual(sizes, []int{32, 19}) {
+		t.Errorf("List() = %v, %v", sizes, err)
+	}
+
+	uids, err := mailbox.UIDs()
+	if err != nil || !reflect.DeepEqual(uids, []string{"uid-1", "uid-2"}) {
+		t.Errorf("UIDs() = %v, %v", uids, err)
+	}
+
+	var msg []byte
+	err = mailbox.Fetch(2, func(r io.Reader) error {
+		msg, err = ioutil.ReadAll(r)
+		return err
+	})
+	if err != nil || string(msg) != "Subject: two\n\nbody\n" {
+		t.Errorf("Fetch(2) = %q, %v", msg, err)
+	}
+
+	top, err := mailbox.Top(1, 1)
+	if err != nil || top != "Subject: one\r\n\r\nline 1\r\n" {
+		t.Errorf("Top(1, 1) = %q, %v", top, err)
+	}
+
+	for _, n := range []int{0, 3} {
+		if _, err := mailbox.Size(n); err != errNoSuchMessage {
+			t.Errorf("Size(%d) = %v, expected errNoSuchMessage", n, err)
+		}
+		if _, err := mailbox.UID(n); err != errNoSuchMessage {
+			t.Errorf("UID(%d) = %v, expected errNoSuchMessage", n, err)
+		}
+		if _, err := mailbox.Top(n, 0); err != errNoSuchMessage {
+			t.Errorf("Top(%d, 0) = %v, expected errNoSuchMessage", n, err)
+		}
+	}
+}
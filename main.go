@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/op/go-logging"
 )
@@ -15,6 +21,9 @@ var (
 // Conf global config
 var Conf *ServerConfig
 
+// default time to wait for sessions to end on shutdown
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
 	// config path
 	var config string
@@ -29,9 +38,47 @@ func main() {
 	logging.SetLevel(logging.INFO, "logger")
 	logging.SetFormatter(logging.MustStringFormatter(format))
 
+	// pool of IMAP sessions reused between POP3 sessions
+	imapSessions = newIMAPPool(Conf.IMAP.PoolSize, time.Duration(Conf.IMAP.PoolIdle)*time.Second)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
 	// Run webinterface
-	go RunWebInterface(Conf.HTTP.Port)
+	web := RunWebInterface(Conf.HTTP.Port)
 
 	// pop3 server
-	POP3Server(Conf.POP.Port, Conf.POP.TLS)
+	pop := POP3Server(Conf.POP.Listeners())
+
+	sig := <-signals
+	Log.Infof("received %s, shutting down", sig)
+
+	timeout := defaultShutdownTimeout
+	if Conf.POP.ShutdownTimeout > 0 {
+		timeout = time.Duration(Conf.POP.ShutdownTimeout) * time.Second
+	}
+
+	// stop both servers at the same time, so they share the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var servers sync.WaitGroup
+	servers.Add(1)
+	go func() {
+		defer servers.Done()
+		pop.Shutdown(timeout)
+	}()
+
+	err := web.Shutdown(ctx)
+	if err != nil {
+		Log.Errorf("web interface shutdown: %s", err)
+	}
+
+	servers.Wait()
+
+	// log out of the pooled IMAP sessions. Database connections are only
+	// held while handling a request, so they are closed at this point.
+	imapSessions.Close()
+
+	Log.Info("shutdown complete")
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+)
+
+// multilineWriter writes the body of a POP3 multi-line response (RFC 1939
+// section 3). Lines beginning with the termination octet are byte-stuffed and
+// bare LFs are converted to CRLF. Close terminates the response.
+type multilineWriter struct {
+	w   io.Writer
+	bol bool // at the beginning of a line
+	cr  bool // last octet written was CR
+}
+
+// newMultilineWriter creates a multi-line response writer writing to w
+func newMultilineWriter(w io.Writer) *multilineWriter {
+	return &multilineWriter{w: w, bol: true}
+}
+
+// Write writes p to the underlying writer with dot-stuffing and line endings
+// normalized. It returns the number of octets consumed from p.
+func (m *multilineWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+len(p)/64+2)
+
+	for _, c := range p {
+		if m.bol && c == '.' {
+			buf = append(buf, '.')
+		}
+
+		if c == '\n' && !m.cr {
+			buf = append(buf, '\r')
+		}
+
+		buf = append(buf, c)
+		m.cr = c == '\r'
+		m.bol = c == '\n'
+	}
+
+	_, err := m.w.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close terminates the last line if needed and writes the termination octet
+func (m *multilineWriter) Close() error {
+	if !m.bol {
+		_, err := io.WriteString(m.w, eol)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(m.w, "."+eol)
+	return err
+}
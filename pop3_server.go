@@ -1,203 +1,242 @@
 package main
 
 import (
-	"bufio"
 	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"os"
-	"strings"
+	"sync"
+	"time"
 )
 
-type popState int
-
-const (
-	stateUnauthorized popState = iota
-	stateTransaction
-	stateUpdate
-)
-
-const (
-	eol = "\r\n"
-)
+// popServer accepts POP3 connections on a set of listeners and keeps track of
+// the active sessions so they can be drained on shutdown
+type popServer struct {
+	quit     chan struct{}
+	sessions sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	// number of sessions per remote IP
+	ips map[string]int
+	// listeners and the goroutines accepting connections on them
+	netlisteners []net.Listener
+	serving      sync.WaitGroup
+}
 
-// POP3Server spawn a simple pop3 server which acts as a proxy to KUmail
-func POP3Server(port int, secure bool) {
-	var err error
-	var netlistener net.Listener
+// POP3Server spawn a simple pop3 server which acts as a proxy to KUmail. The
+// server accepts connections on all of the given listeners until it is shut
+// down.
+func POP3Server(listeners []popListener) *popServer {
+	srv := &popServer{
+		quit:         make(chan struct{}),
+		conns:        make(map[net.Conn]bool),
+		ips:          make(map[string]int),
+		netlisteners: make([]net.Listener, len(listeners)),
+	}
 
-	tcpPort := fmt.Sprintf(":%d", port)
+	configs := make([]*tls.Config, len(listeners))
 
-	if secure {
-		var certificate tls.Certificate
-		certificate, err = tls.LoadX509KeyPair(Conf.POP.Cert, Conf.POP.Key)
+	// bind all listeners before accepting any connections
+	for i, l := range listeners {
+		netlistener, config, err := listen(l)
 		if err != nil {
-			Log.Errorf("unable to load certificate: %s", err)
+			Log.Errorf("listen error (%s): %s", l.Address, err)
 			os.Exit(1)
 		}
 
-		config := tls.Config{
-			Certificates: []tls.Certificate{certificate},
-			ClientAuth:   tls.NoClientCert,
-			MinVersion:   tls.VersionTLS10,
-		}
-		config.Rand = rand.Reader
+		srv.netlisteners[i] = netlistener
+		configs[i] = config
 
-		netlistener, err = tls.Listen("tcp", tcpPort, &config)
-	} else {
-		netlistener, err = net.Listen("tcp", tcpPort)
+		Log.Infof("POP3 server listening on: %s (tls: %s)", l.Address, l.TLS)
 	}
 
-	if err != nil {
-		Log.Errorf("listen error: %s", err)
-		os.Exit(1)
+	for i, l := range listeners {
+		srv.serving.Add(1)
+		go func(netlistener net.Listener, l popListener, config *tls.Config) {
+			defer srv.serving.Done()
+			srv.serve(netlistener, l, config)
+		}(srv.netlisteners[i], l, configs[i])
 	}
 
-	Log.Infof("POP3 server listening on port: %d", port)
+	return srv
+}
+
+// Shutdown stops accepting connections and waits for the active sessions to
+// end. Idle sessions are ended right away with a [SYS/TEMP] response while
+// sessions running a command are ended when the command is done. Sessions
+// still active after timeout are disconnected.
+func (srv *popServer) Shutdown(timeout time.Duration) {
+	close(srv.quit)
 
-	if secure {
-		Log.Info("Using TLS")
+	for _, netlistener := range srv.netlisteners {
+		netlistener.Close()
 	}
+	srv.serving.Wait()
 
-	for {
-		conn, err := netlistener.Accept()
-		if err != nil {
-			Log.Errorf("accept error: %s", err)
-		}
-		go handleConn(conn)
+	// wake up sessions waiting for the next command
+	srv.mu.Lock()
+	Log.Infof("waiting for %d POP3 sessions to end", len(srv.conns))
+	for conn := range srv.conns {
+		conn.SetReadDeadline(time.Now())
 	}
+	srv.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	srv.mu.Lock()
+	Log.Infof("disconnecting %d POP3 sessions", len(srv.conns))
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	<-done
 }
 
-func handleConn(conn net.Conn) {
-	defer conn.Close()
+// track registers the connection conn from ip as an active session unless the
+// limit of concurrent sessions in total or from ip has been reached
+func (srv *popServer) track(conn net.Conn, ip string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
 
-	kumailClient := new(KUmail)
+	if Conf.POP.MaxSessions > 0 && len(srv.conns) >= Conf.POP.MaxSessions {
+		return errors.New("too many sessions")
+	}
 
-	var (
-		state = stateUnauthorized
-	)
+	if Conf.POP.MaxSessionsPerIP > 0 && srv.ips[ip] >= Conf.POP.MaxSessionsPerIP {
+		return errors.New("too many sessions from your address")
+	}
 
-	reader := bufio.NewReader(conn)
+	srv.conns[conn] = true
+	srv.ips[ip]++
+	return nil
+}
 
-	writeClient(conn, "+OK simple KUmail POP3 -> IMAP proxy")
+// untrack removes the session of conn from ip
+func (srv *popServer) untrack(conn net.Conn, ip string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			Log.Error(err.Error())
-			return
-		}
+	delete(srv.conns, conn)
+	srv.ips[ip]--
+	if srv.ips[ip] == 0 {
+		delete(srv.ips, ip)
+	}
+}
 
-		Log.Debugf("-> %s", line)
+// get the IP address of the remote end of conn
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
 
-		// Parse command
-		cmd, args := readCommand(line)
+// listen binds the listener l. If the listener uses TLS or STLS the TLS config
+// is returned as well.
+func listen(l popListener) (net.Listener, *tls.Config, error) {
+	switch l.TLS {
+	case tlsImplicit:
+		config, err := loadTLSConfig(l.Cert, l.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load certificate: %s", err)
+		}
 
-		if cmd == "USER" && state == stateUnauthorized {
-			// accept username and wait for PASS command
-			username, _ := getSafeArgs(args, 0)
-			kumailClient.User = username
-			writeClient(conn, "+OK user accepted")
-		} else if cmd == "PASS" && state == stateUnauthorized {
-			pass, _ := getSafeArgs(args, 0)
+		netlistener, err := tls.Listen("tcp", l.Address, config)
+		return netlistener, config, err
+	case tlsSTLS:
+		config, err := loadTLSConfig(l.Cert, l.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load certificate: %s", err)
+		}
 
-			settings, err := GetSettings(kumailClient.User)
-			if err != nil {
-				writeClient(conn, "-ERR unable to get user settings!")
-				return
-			}
+		netlistener, err := net.Listen("tcp", l.Address)
+		return netlistener, config, err
+	case tlsNone:
+		netlistener, err := net.Listen("tcp", l.Address)
+		return netlistener, nil, err
+	default:
+		return nil, nil, fmt.Errorf("invalid tls mode '%s'", l.TLS)
+	}
+}
 
-			if settings == nil {
-				writeClient(conn, "-ERR account not registered!")
-				return
-			}
+// serve accepts connections on netlistener and spawns a POP3 session for each
+// of them
+func (srv *popServer) serve(netlistener net.Listener, l popListener, config *tls.Config) {
+	// only plaintext connections can be upgraded with STLS
+	var stlsConfig *tls.Config
+	if l.TLS == tlsSTLS {
+		stlsConfig = config
+	}
 
-			kumailClient.Pass = pass
-			if kumailClient.Init(settings) {
-				writeClient(conn, "+OK pass accepted")
-				state = stateTransaction
-			} else {
-				writeClient(conn, "-ERR Username or password incorrect!")
-			}
-		} else if cmd == "CAPA" && state == stateTransaction {
-			writeClient(conn, "+OK Capability list follows")
-			writeClient(conn, "UIDL")
-			writeClient(conn, "USER")
-			writeClient(conn, ".")
-		} else if cmd == "UIDL" && state == stateTransaction {
-			list, err := kumailClient.UIDL()
-			if err != nil {
-				kumailClient.Close()
-				Log.Error(err.Error())
-				writeClient(conn, "-ERR unable to perform UIDL")
-				return
-			}
-			writeClient(conn, "+OK")
-			// TODO buffer this stuff and send as a single command?
-			for _, msg := range list {
-				writeClient(conn, "%s %d", msg.ID, msg.UID)
-			}
-			writeClient(conn, ".")
-		} else if cmd == "LIST" && state == stateTransaction {
-			list, total, err := kumailClient.ListAll()
-			if err != nil {
-				kumailClient.Close()
-				Log.Error(err.Error())
-				writeClient(conn, "-ERR unable to perform LIST")
-				return
-			}
-			writeClient(conn, "+OK %d messages (%d octets)", len(list), total)
-			// TODO buffer this stuff and send as a single command?
-			for _, msg := range list {
-				writeClient(conn, "%s %d", msg.ID, msg.size)
-			}
-			writeClient(conn, ".")
-		} else if cmd == "RETR" && state == stateTransaction {
-			id, _ := getSafeArgs(args, 0)
-			msg, octets, err := kumailClient.GetMessage(id)
-			if err != nil {
-				kumailClient.Close()
-				Log.Error(err.Error())
-				writeClient(conn, "-ERR no such message")
+	for {
+		conn, err := netlistener.Accept()
+		if err != nil {
+			select {
+			case <-srv.quit:
 				return
+			default:
 			}
 
-			writeClient(conn, "+OK %d octets", octets)
-			// send message
-			fmt.Fprintf(conn, msg+eol)
-			writeClient(conn, ".")
-		} else if cmd == "DELE" && state == stateTransaction {
-			writeClient(conn, "-ERR you are not allowed to delete messages on this server")
-		} else if cmd == "QUIT" {
-			// take down IMAP connection
-			kumailClient.Close()
-			writeClient(conn, "+OK Bye bye!")
-			return
-		} else {
-			writeClient(conn, "-ERR invalid command")
-			return // close connection on invalid command
+			Log.Errorf("accept error (%s): %s", l.Address, err)
+			continue
 		}
+
+		srv.sessions.Add(1)
+		go srv.handleConn(conn, stlsConfig)
 	}
 }
 
-// read commands send by client
-func readCommand(line string) (string, []string) {
-	line = strings.Trim(line, "\r \n")
-	cmd := strings.Split(line, " ")
-	return cmd[0], cmd[1:]
-}
+// loadTLSConfig loads the certificate/key pair and sets up a TLS config for the
+// POP3 server. The certificate is reloaded when it changes on disk.
+func loadTLSConfig(cert, key string) (*tls.Config, error) {
+	loader, err := newCertLoader(cert, key)
+	if err != nil {
+		return nil, err
+	}
 
-func getSafeArgs(args []string, n int) (string, error) {
-	if n < len(args) {
-		return args[n], nil
+	config := &tls.Config{
+		GetCertificate: loader.GetCertificate,
+		ClientAuth:     tls.NoClientCert,
+		MinVersion:     tls.VersionTLS10,
 	}
-	return "", errors.New("out of range")
+	config.Rand = rand.Reader
+
+	return config, nil
 }
 
-// write message to client and print the message in the server log
-func writeClient(conn net.Conn, msg string, args ...interface{}) {
-	fmt.Fprintf(conn, msg+eol, args...)
-	Log.Debugf("<- "+msg+eol, args...)
+// handleConn handles a POP3 session. If stlsConfig is not nil the client is
+// allowed to upgrade the connection to TLS with the STLS command.
+func (srv *popServer) handleConn(conn net.Conn, stlsConfig *tls.Config) {
+	defer srv.sessions.Done()
+	defer conn.Close()
+
+	ip := remoteIP(conn)
+
+	err := srv.track(conn, ip)
+	if err != nil {
+		Log.Infof("refusing connection from %s: %s", ip, err)
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		writeClient(conn, "-ERR [%s] %s, try again later", respSysTemp, err)
+		return
+	}
+	defer srv.untrack(conn, ip)
+
+	s := newPopSession(conn, KUmailBackend{}, stlsConfig)
+	s.quit = srv.quit
+	s.ip = ip
+	s.run()
 }
@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type popState int
+
+const (
+	stateUnauthorized popState = iota
+	stateTransaction
+	stateUpdate
+)
+
+const (
+	eol = "\r\n"
+)
+
+// extended response codes (RFC 2449, RFC 3206)
+const (
+	respAuth    = "AUTH"
+	respSysTemp = "SYS/TEMP"
+	respSysPerm = "SYS/PERM"
+	respInUse   = "IN-USE"
+)
+
+// default number of consecutive invalid commands before the connection is
+// closed
+const defaultMaxErrors = 10
+
+// default time a client can be idle before it is logged out, RFC 1939
+// requires at least 10 minutes
+const defaultPopTimeout = 10 * time.Minute
+
+// supported SASL mechanisms
+var saslMechanisms = []string{"PLAIN"}
+
+// errQuit is returned by a command handler when the client ends the session
+var errQuit = errors.New("session ended by client")
+
+// popCommand defines the states a command is accepted in and the handler of
+// the command. If the handler returns an error the session is ended.
+type popCommand struct {
+	states  []popState
+	handler func(s *popSession, args []string) error
+}
+
+// commands defines the commands understood by the server
+var commands = map[string]popCommand{
+	"USER": {[]popState{stateUnauthorized}, cmdUSER},
+	"PASS": {[]popState{stateUnauthorized}, cmdPASS},
+	"AUTH": {[]popState{stateUnauthorized}, cmdAUTH},
+	"STLS": {[]popState{stateUnauthorized}, cmdSTLS},
+	"STAT": {[]popState{stateTransaction}, cmdSTAT},
+	"LIST": {[]popState{stateTransaction}, cmdLIST},
+	"UIDL": {[]popState{stateTransaction}, cmdUIDL},
+	"RETR": {[]popState{stateTransaction}, cmdRETR},
+	"TOP":  {[]popState{stateTransaction}, cmdTOP},
+	"DELE": {[]popState{stateTransaction}, cmdDELE},
+	"NOOP": {[]popState{stateTransaction}, cmdNOOP},
+	"RSET": {[]popState{stateTransaction}, cmdRSET},
+	"CAPA": {[]popState{stateUnauthorized, stateTransaction}, cmdCAPA},
+	"QUIT": {[]popState{stateUnauthorized, stateTransaction}, cmdQUIT},
+}
+
+// check if the command is accepted in state
+func (c popCommand) allowed(state popState) bool {
+	for _, s := range c.states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// popSession holds the state of a single POP3 session
+type popSession struct {
+	conn       io.ReadWriter
+	reader     *bufio.Reader
+	backend    Backend
+	mailbox    Mailbox // mailbox of the user, set after login
+	stlsConfig *tls.Config
+	secure     bool
+	state      popState
+	user       string
+	// messages marked as deleted in the current session
+	deleted map[int]bool
+	// number of consecutive invalid commands
+	errCount int
+	// closed when the server shuts down
+	quit <-chan struct{}
+	// IP address of the client
+	ip string
+}
+
+// newPopSession creates a POP3 session on conn where users are authenticated
+// by backend. If stlsConfig is not nil and conn is a net.Conn, the client is
+// allowed to upgrade the connection to TLS with the STLS command.
+func newPopSession(conn io.ReadWriter, backend Backend, stlsConfig *tls.Config) *popSession {
+	_, secure := conn.(*tls.Conn)
+
+	return &popSession{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		backend:    backend,
+		stlsConfig: stlsConfig,
+		secure:     secure,
+		state:      stateUnauthorized,
+		deleted:    make(map[int]bool),
+	}
+}
+
+// run the session until the client quits or the connection is closed
+func (s *popSession) run() {
+	defer s.closeMailbox()
+
+	// on implicit TLS connections writing the greeting waits for the TLS
+	// handshake, which must not block forever
+	s.setReadDeadline()
+	s.write("+OK simple KUmail POP3 -> IMAP proxy")
+
+	for {
+		s.setReadDeadline()
+
+		// the server wakes up sessions waiting for a command when it
+		// shuts down, so quit must be checked after setting the deadline
+		if s.shuttingDown() {
+			return
+		}
+
+		line, err := s.reader.ReadString('\n')
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && s.shuttingDown() {
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// autologout, the session ends without entering the UPDATE
+			// state so no messages are deleted
+			Log.Infof("autologout of idle client (%s)", s.user)
+			return
+		}
+		if err != nil {
+			Log.Error(err.Error())
+			return
+		}
+
+		Log.Debugf("-> %s", line)
+
+		// Parse command
+		cmd, args := readCommand(line)
+
+		err = s.dispatch(cmd, args)
+		if err != nil {
+			if err != errQuit {
+				Log.Error(err.Error())
+			}
+			return
+		}
+	}
+}
+
+// dispatch cmd to its handler if it is allowed in the current state. Invalid
+// commands are answered with an error, and the session is only ended after too
+// many consecutive invalid commands.
+func (s *popSession) dispatch(cmd string, args []string) error {
+	command, ok := commands[cmd]
+	if !ok || !command.allowed(s.state) {
+		if ok {
+			s.write("-ERR %s not allowed in this state", cmd)
+		} else {
+			s.write("-ERR unknown command")
+		}
+
+		s.errCount++
+		if s.errCount >= maxErrors() {
+			s.write("-ERR too many errors, closing connection")
+			return fmt.Errorf("closing connection after %d consecutive errors", s.errCount)
+		}
+		return nil
+	}
+
+	s.errCount = 0
+	return command.handler(s, args)
+}
+
+// write message to the client
+func (s *popSession) write(msg string, args ...interface{}) {
+	writeClient(s, msg, args...)
+}
+
+// Write writes p to the client. Every write must complete within the timeout,
+// so a long response, e.g. a large message, doesn't time out as long as the
+// client keeps receiving it.
+func (s *popSession) Write(p []byte) (int, error) {
+	conn, ok := s.conn.(interface {
+		SetWriteDeadline(t time.Time) error
+	})
+	if ok {
+		conn.SetWriteDeadline(time.Now().Add(popTimeout()))
+	}
+	return s.conn.Write(p)
+}
+
+// fail reports a backend error to the client and ends the session
+func (s *popSession) fail(err error, msg string) error {
+	s.write(msg)
+	return err
+}
+
+// shuttingDown returns true if the server is shutting down, in which case the
+// client is told to come back later. The session ends without entering the
+// UPDATE state.
+func (s *popSession) shuttingDown() bool {
+	select {
+	case <-s.quit:
+		s.write("-ERR [%s] server shutting down", respSysTemp)
+		return true
+	default:
+		return false
+	}
+}
+
+// setReadDeadline sets the time the client has to send the next command, if
+// the connection supports deadlines
+func (s *popSession) setReadDeadline() {
+	conn, ok := s.conn.(interface {
+		SetReadDeadline(t time.Time) error
+	})
+	if ok {
+		conn.SetReadDeadline(time.Now().Add(popTimeout()))
+	}
+}
+
+// closeMailbox closes the mailbox of the user if logged in
+func (s *popSession) closeMailbox() {
+	if s.mailbox == nil {
+		return
+	}
+
+	err := s.mailbox.Close()
+	if err != nil {
+		Log.Error(err.Error())
+	}
+	s.mailbox = nil
+}
+
+// tlsRequired returns true if the client must use STLS before logging in
+func (s *popSession) tlsRequired() bool {
+	return !s.secure && Conf.POP.RequireTLS
+}
+
+// login authenticates the user with the backend and enters the TRANSACTION
+// state on success
+func (s *popSession) login(user, pass string) error {
+	if !loginLimits.Allowed(s.ip, user) {
+		s.write("-ERR [%s] too many failed logins, try again later", respSysTemp)
+		return nil
+	}
+
+	mailbox, err := s.backend.Login(user, pass)
+	if err == nil {
+		loginLimits.Succeeded(s.ip, user)
+		s.mailbox = mailbox
+		s.write("+OK pass accepted")
+		s.state = stateTransaction
+		return nil
+	}
+
+	lerr, ok := err.(*LoginError)
+	if !ok {
+		lerr = &LoginError{respSysTemp, err}
+	}
+
+	switch lerr.Code {
+	case respAuth:
+		loginLimits.Failed(s.ip, user)
+		s.write("-ERR [%s] Username or password incorrect!", respAuth)
+	case respInUse:
+		s.write("-ERR [%s] mailbox is locked by another session", respInUse)
+	case respSysPerm:
+		s.write("-ERR [%s] %s", respSysPerm, lerr.Err)
+		return err
+	default:
+		s.write("-ERR [%s] KUmail is unavailable, try again later", respSysTemp)
+	}
+	return nil
+}
+
+// count the messages not marked as deleted and their total size in octets
+func (s *popSession) stat(sizes []int) (int, int) {
+	count, total := 0, 0
+	for i, size := range sizes {
+		if !s.deleted[i+1] {
+			count++
+			total += size
+		}
+	}
+	return count, total
+}
+
+// parse the message number of a command and make sure it is not marked as
+// deleted
+func (s *popSession) msgNumber(args []string) (int, bool) {
+	n, err := parseMsgNumber(args)
+	if err != nil || s.deleted[n] {
+		return 0, false
+	}
+	return n, true
+}
+
+func cmdUSER(s *popSession, args []string) error {
+	if s.tlsRequired() {
+		s.write("-ERR TLS required, use STLS first")
+		return nil
+	}
+
+	// accept username and wait for PASS command
+	s.user, _ = getSafeArgs(args, 0)
+	s.write("+OK user accepted")
+	return nil
+}
+
+func cmdPASS(s *popSession, args []string) error {
+	if s.tlsRequired() {
+		s.write("-ERR TLS required, use STLS first")
+		return nil
+	}
+
+	pass, _ := getSafeArgs(args, 0)
+	return s.login(s.user, pass)
+}
+
+func cmdAUTH(s *popSession, args []string) error {
+	if s.tlsRequired() {
+		s.write("-ERR TLS required, use STLS first")
+		return nil
+	}
+
+	if len(args) == 0 {
+		// list supported SASL mechanisms
+		s.write("+OK")
+		for _, mechanism := range saslMechanisms {
+			s.write(mechanism)
+		}
+		s.write(".")
+		return nil
+	}
+
+	if strings.ToUpper(args[0]) != "PLAIN" {
+		s.write("-ERR unsupported authentication mechanism")
+		return nil
+	}
+
+	response, err := getSafeArgs(args, 1)
+	if err != nil {
+		// no initial response, ask the client for it
+		s.write("+ ")
+		s.setReadDeadline()
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		response = strings.Trim(line, "\r\n")
+	}
+
+	if response == "*" {
+		s.write("-ERR authentication cancelled")
+		return nil
+	}
+
+	user, pass, err := decodePlain(response)
+	if err != nil {
+		s.write("-ERR invalid authentication response")
+		return nil
+	}
+
+	return s.login(user, pass)
+}
+
+func cmdSTLS(s *popSession, args []string) error {
+	conn, ok := s.conn.(net.Conn)
+	if !ok || s.secure || s.stlsConfig == nil {
+		s.write("-ERR STLS not available")
+		return nil
+	}
+
+	s.write("+OK begin TLS negotiation")
+
+	tlsConn := tls.Server(conn, s.stlsConfig)
+	conn.SetDeadline(time.Now().Add(popTimeout()))
+	err := tlsConn.Handshake()
+	if err != nil {
+		return fmt.Errorf("TLS handshake failed: %s", err)
+	}
+
+	// discard any state from before the TLS negotiation (RFC 2595)
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(tlsConn)
+	s.secure = true
+	s.user = ""
+	s.errCount = 0
+	return nil
+}
+
+func cmdCAPA(s *popSession, args []string) error {
+	s.write("+OK Capability list follows")
+	for _, capa := range capabilities(s.state, s.secure, s.stlsConfig != nil) {
+		s.write(capa)
+	}
+	s.write(".")
+	return nil
+}
+
+func cmdSTAT(s *popSession, args []string) error {
+	sizes, err := s.mailbox.List()
+	if err != nil {
+		return s.fail(err, "-ERR unable to perform STAT")
+	}
+	count, total := s.stat(sizes)
+	s.write("+OK %d %d", count, total)
+	return nil
+}
+
+func cmdLIST(s *popSession, args []string) error {
+	if len(args) > 0 {
+		n, ok := s.msgNumber(args)
+		if !ok {
+			s.write("-ERR no such message")
+			return nil
+		}
+
+		size, err := s.mailbox.Size(n)
+		if err == errNoSuchMessage {
+			s.write("-ERR no such message")
+			return nil
+		}
+		if err != nil {
+			return s.fail(err, "-ERR unable to perform LIST")
+		}
+		s.write("+OK %d %d", n, size)
+		return nil
+	}
+
+	sizes, err := s.mailbox.List()
+	if err != nil {
+		return s.fail(err, "-ERR unable to perform LIST")
+	}
+	count, total := s.stat(sizes)
+	s.write("+OK %d messages (%d octets)", count, total)
+
+	w := newMultilineWriter(s)
+	for i, size := range sizes {
+		if !s.deleted[i+1] {
+			fmt.Fprintf(w, "%d %d\n", i+1, size)
+		}
+	}
+	return w.Close()
+}
+
+func cmdUIDL(s *popSession, args []string) error {
+	if len(args) > 0 {
+		n, ok := s.msgNumber(args)
+		if !ok {
+			s.write("-ERR no such message")
+			return nil
+		}
+
+		uid, err := s.mailbox.UID(n)
+		if err == errNoSuchMessage {
+			s.write("-ERR no such message")
+			return nil
+		}
+		if err != nil {
+			return s.fail(err, "-ERR unable to perform UIDL")
+		}
+		s.write("+OK %d %s", n, uid)
+		return nil
+	}
+
+	uids, err := s.mailbox.UIDs()
+	if err != nil {
+		return s.fail(err, "-ERR unable to perform UIDL")
+	}
+	s.write("+OK")
+
+	w := newMultilineWriter(s)
+	for i, uid := range uids {
+		if !s.deleted[i+1] {
+			fmt.Fprintf(w, "%d %s\n", i+1, uid)
+		}
+	}
+	return w.Close()
+}
+
+func cmdRETR(s *popSession, args []string) error {
+	n, ok := s.msgNumber(args)
+	if !ok {
+		s.write("-ERR no such message")
+		return nil
+	}
+
+	// the response is started when the message has been received from the
+	// backend, from then on errors can only be reported by closing the
+	// connection
+	started := false
+
+	err := s.mailbox.Fetch(n, func(r io.Reader) error {
+		spool, size, err := spoolMessage(r)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		started = true
+		s.write("+OK %d octets", size)
+
+		_, err = io.Copy(s, spool)
+		return err
+	})
+	if err == errNoSuchMessage && !started {
+		s.write("-ERR no such message")
+		return nil
+	}
+	if err != nil && !started {
+		return s.fail(err, "-ERR unable to perform RETR")
+	}
+	return err
+}
+
+// spoolMessage writes the message read from r as a multi-line response to a
+// temporary file, so the exact number of octets sent to the client after
+// dot-stuffing is known before the response is started, without keeping the
+// message in memory. The file is returned positioned at its start along with
+// the size of the message excluding the termination octet.
+func spoolMessage(r io.Reader) (*os.File, int64, error) {
+	spool, err := ioutil.TempFile("", "gokumail")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	w := newMultilineWriter(spool)
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Close()
+	}
+
+	var size int64
+	if err == nil {
+		size, err = spool.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, 0, err
+	}
+
+	return spool, size - int64(len("."+eol)), nil
+}
+
+func cmdTOP(s *popSession, args []string) error {
+	n, ok := s.msgNumber(args)
+	if !ok {
+		s.write("-ERR no such message")
+		return nil
+	}
+
+	arg, _ := getSafeArgs(args, 1)
+	lines, err := strconv.Atoi(arg)
+	if err != nil || lines < 0 {
+		s.write("-ERR invalid number of lines")
+		return nil
+	}
+
+	msg, err := s.mailbox.Top(n, lines)
+	if err == errNoSuchMessage {
+		s.write("-ERR no such message")
+		return nil
+	}
+	if err != nil {
+		return s.fail(err, "-ERR unable to perform TOP")
+	}
+
+	s.write("+OK top of message follows")
+
+	w := newMultilineWriter(s)
+	_, err = io.WriteString(w, msg)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func cmdDELE(s *popSession, args []string) error {
+	n, err := parseMsgNumber(args)
+	if err != nil {
+		s.write("-ERR no such message")
+		return nil
+	}
+
+	if s.deleted[n] {
+		s.write("-ERR message %d already deleted", n)
+		return nil
+	}
+
+	_, err = s.mailbox.Size(n)
+	if err == errNoSuchMessage {
+		s.write("-ERR no such message")
+		return nil
+	}
+	if err != nil {
+		return s.fail(err, "-ERR unable to perform DELE")
+	}
+
+	s.deleted[n] = true
+	s.write("+OK message %d deleted", n)
+	return nil
+}
+
+func cmdNOOP(s *popSession, args []string) error {
+	s.write("+OK")
+	return nil
+}
+
+func cmdRSET(s *popSession, args []string) error {
+	s.deleted = make(map[int]bool)
+	s.write("+OK")
+	return nil
+}
+
+func cmdQUIT(s *popSession, args []string) error {
+	if s.state == stateTransaction {
+		s.state = stateUpdate
+
+		// remove messages marked as deleted
+		ns := make([]int, 0, len(s.deleted))
+		for n := range s.deleted {
+			ns = append(ns, n)
+		}
+		sort.Ints(ns)
+
+		err := s.mailbox.Delete(ns)
+		if err != nil {
+			return s.fail(err, "-ERR some deleted messages not removed")
+		}
+	}
+
+	// take down IMAP connection
+	s.closeMailbox()
+	s.write("+OK Bye bye!")
+	return errQuit
+}
+
+// read commands send by client. Commands are case-insensitive and returned in
+// upper case
+func readCommand(line string) (string, []string) {
+	line = strings.Trim(line, "\r \n")
+	cmd := strings.Split(line, " ")
+	return strings.ToUpper(cmd[0]), cmd[1:]
+}
+
+// get the number of consecutive invalid commands allowed before the
+// connection is closed
+func maxErrors() int {
+	if Conf.POP.MaxErrors > 0 {
+		return Conf.POP.MaxErrors
+	}
+	return defaultMaxErrors
+}
+
+// get the time a client can be idle before it is logged out, values below the
+// minimum required by RFC 1939 are raised to it
+func popTimeout() time.Duration {
+	timeout := time.Duration(Conf.POP.Timeout) * time.Second
+	if timeout < defaultPopTimeout {
+		return defaultPopTimeout
+	}
+	return timeout
+}
+
+func getSafeArgs(args []string, n int) (string, error) {
+	if n < len(args) {
+		return args[n], nil
+	}
+	return "", errors.New("out of range")
+}
+
+// parse the message number given as the first argument of a command
+func parseMsgNumber(args []string) (int, error) {
+	arg, err := getSafeArgs(args, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 1 {
+		return 0, errNoSuchMessage
+	}
+
+	return n, nil
+}
+
+// capabilities lists the capabilities (RFC 2449) of the server in the given
+// state. secure is true if the connection is using TLS and stls is true if the
+// connection can be upgraded with STLS.
+func capabilities(state popState, secure, stls bool) []string {
+	capas := []string{
+		"TOP",
+		"UIDL",
+		"RESP-CODES",
+		"AUTH-RESP-CODE",
+		"PIPELINING",
+		"EXPIRE NEVER",
+	}
+
+	if Conf.POP.LoginDelay > 0 {
+		capas = append(capas, fmt.Sprintf("LOGIN-DELAY %d", Conf.POP.LoginDelay))
+	}
+
+	if state == stateUnauthorized {
+		if !secure && stls {
+			capas = append(capas, "STLS")
+		}
+
+		// login is only allowed when TLS is not required or already active
+		if secure || !Conf.POP.RequireTLS {
+			capas = append(capas, "USER")
+			capas = append(capas, "SASL "+strings.Join(saslMechanisms, " "))
+		}
+	}
+
+	return append(capas, "IMPLEMENTATION gokumail")
+}
+
+// decode a SASL PLAIN response (RFC 4616) and return the username and password
+func decodePlain(response string) (string, string, error) {
+	// a single "=" is an empty initial response (RFC 5034)
+	if response == "=" {
+		response = ""
+	}
+
+	data, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", "", err
+	}
+
+	// authzid NUL authcid NUL passwd
+	parts := strings.Split(string(data), "\x00")
+	if len(parts) != 3 {
+		return "", "", errors.New("malformed PLAIN response")
+	}
+
+	if parts[0] != "" && parts[0] != parts[1] {
+		return "", "", errors.New("authorization identity differs from authentication identity")
+	}
+
+	return parts[1], parts[2], nil
+}
+
+// write message to client and print the message in the server log
+func writeClient(w io.Writer, msg string, args ...interface{}) {
+	fmt.Fprintf(w, msg+eol, args...)
+	Log.Debugf("<- "+msg+eol, args...)
+}
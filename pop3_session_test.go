@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const greeting = "+OK simple KUmail POP3 -> IMAP proxy\r\n"
+
+// transcript runs a POP3 session reading the client commands from input and
+// returns everything sent by the server
+func transcript(backend Backend, input ...string) string {
+	return transcriptConf(backend, &ServerConfig{}, input...)
+}
+
+// transcriptConf runs a POP3 session like transcript using the configuration
+// conf
+func transcriptConf(backend Backend, conf *ServerConfig, input ...string) string {
+	Conf = conf
+	loginLimits = &loginLimiter{failures: make(map[string]*loginFailures)}
+
+	var out bytes.Buffer
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(strings.Join(input, "")), &out}
+
+	newPopSession(conn, backend, nil).run()
+	return out.String()
+}
+
+func testBackend() *memBackend {
+	return &memBackend{
+		user: "user",
+		pass: "secret",
+		mailbox: newMemMailbox(
+			"Subject: one\r\n\r\n.dot\r\nline 2\r\n",
+			"Subject: two\n\nbody\n..\n",
+		),
+	}
+}
+
+func checkTranscript(t *testing.T, got string, expected ...string) {
+	if got != strings.Join(expected, "") {
+		t.Errorf("unexpected transcript\ngot:\n%s\nexpected:\n%s", got, strings.Join(expected, ""))
+	}
+}
+
+func TestSessionUserPass(t *testing.T) {
+	backend := testBackend()
+
+	out := transcript(backend,
+		"USER user\r\n",
+		"PASS wrong\r\n",
+		"PASS secret\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"+OK user accepted\r\n",
+		"-ERR [AUTH] Username or password incorrect!\r\n",
+		"-ERR [SYS/TEMP] too many failed logins, try again later\r\n",
+	)
+
+	out = transcript(backend,
+		"user user\r\n",
+		"pass secret\r\n",
+		"STAT\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"+OK user accepted\r\n",
+		"+OK pass accepted\r\n",
+		"+OK 2 52\r\n",
+	)
+
+	if !backend.mailbox.closed {
+		t.Error("mailbox not closed when the connection was closed")
+	}
+}
+
+func TestSessionAuthPlain(t *testing.T) {
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+
+	// initial response
+	out := transcript(testBackend(), "AUTH PLAIN "+plain+"\r\n", "NOOP\r\n")
+	checkTranscript(t, out,
+		greeting,
+		"+OK pass accepted\r\n",
+		"+OK\r\n",
+	)
+
+	// continuation
+	out = transcript(testBackend(), "AUTH PLAIN\r\n", plain+"\r\n", "NOOP\r\n")
+	checkTranscript(t, out,
+		greeting,
+		"+ \r\n",
+		"+OK pass accepted\r\n",
+		"+OK\r\n",
+	)
+
+	out = transcript(testBackend(),
+		"AUTH\r\n",
+		"AUTH PLAIN\r\n", "*\r\n",
+		"AUTH PLAIN !!!\r\n",
+		"AUTH CRAM-MD5\r\n",
+		"NOOP\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"+OK\r\n", "PLAIN\r\n", ".\r\n",
+		"+ \r\n", "-ERR authentication cancelled\r\n",
+		"-ERR invalid authentication response\r\n",
+		"-ERR unsupported authentication mechanism\r\n",
+		"-ERR NOOP not allowed in this state\r\n",
+	)
+}
+
+func TestSessionListings(t *testing.T) {
+	out := transcript(testBackend(),
+		"USER user\r\n", "PASS secret\r\n",
+		"STAT\r\n",
+		"LIST\r\n",
+		"LIST 2\r\n",
+		"LIST 3\r\n",
+		"LIST x\r\n",
+		"UIDL\r\n",
+		"UIDL 1\r\n",
+		"UIDL 0\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"+OK user accepted\r\n", "+OK pass accepted\r\n",
+		"+OK 2 52\r\n",
+		"+OK 2 messages (52 octets)\r\n", "1 30\r\n", "2 22\r\n", ".\r\n",
+		"+OK 2 22\r\n",
+		"-ERR no such message\r\n",
+		"-ERR no such message\r\n",
+		"+OK\r\n", "1 uid-1\r\n", "2 uid-2\r\n", ".\r\n",
+		"+OK 1 uid-1\r\n",
+		"-ERR no such message\r\n",
+	)
+}
+
+func TestSessionRetrTop(t *testing.T) {
+	out := transcript(testBackend(),
+		"USER user\r\n", "PASS secret\r\n",
+		"RETR 1\r\n",
+		"RETR 2\r\n",
+		"RETR 3\r\n",
+		"TOP 1 0\r\n",
+		"TOP 2 1\r\n",
+		"TOP 1 -1\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"+OK user accepted\r\n", "+OK pass accepted\r\n",
+		"+OK 31 octets\r\n", "Subject: one\r\n", "\r\n", "..dot\r\n", "line 2\r\n", ".\r\n",
+		"+OK 27 octets\r\n", "Subject: two\r\n", "\r\n", "body\r\n", "...\r\n", ".\r\n",
+		"-ERR no such message\r\n",
+		"+OK top of message follows\r\n", "Subject: one\r\n", "\r\n", ".\r\n",
+		"+OK top of message follows\r\n", "Subject: two\r\n", "\r\n", "body\r\n", ".\r\n",
+		"-ERR invalid number of lines\r\n",
+	)
+}
+
+func TestSessionDelete(t *testing.T) {
+	backend := testBackend()
+
+	out := transcript(backend,
+		"USER user\r\n", "PASS secret\r\n",
+		"DELE 1\r\n",
+		"DELE 1\r\n",
+		"RETR 1\r\n",
+		"RSET\r\n",
+		"DELE 2\r\n",
+		"DELE 3\r\n",
+		"STAT\r\n",
+		"LIST\r\n",
+		"QUIT\r\n",
+		"NOOP\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"+OK user accepted\r\n", "+OK pass accepted\r\n",
+		"+OK message 1 deleted\r\n",
+		"-ERR message 1 already deleted\r\n",
+		"-ERR no such message\r\n",
+		"+OK\r\n",
+		"+OK message 2 deleted\r\n",
+		"-ERR no such message\r\n",
+		"+OK 1 30\r\n",
+		"+OK 1 messages (30 octets)\r\n", "1 30\r\n", ".\r\n",
+		"+OK Bye bye!\r\n",
+	)
+
+	if !reflect.DeepEqual(backend.mailbox.deleted, []int{2}) {
+		t.Errorf("expected message 2 to be removed, removed %v", backend.mailbox.deleted)
+	}
+	if !backend.mailbox.closed {
+		t.Error("mailbox not closed after QUIT")
+	}
+
+	// messages are only removed when the session ends with QUIT
+	backend = testBackend()
+	transcript(backend, "USER user\r\n", "PASS secret\r\n", "DELE 1\r\n")
+	if len(backend.mailbox.deleted) != 0 {
+		t.Errorf("messages removed without QUIT: %v", backend.mailbox.deleted)
+	}
+}
+
+func TestSessionInvalidCommands(t *testing.T) {
+	out := transcript(testBackend(),
+		"STAT\r\n",
+		"FOO\r\n",
+		"USER user\r\n", "PASS secret\r\n",
+		"USER user\r\n",
+		"AUTH PLAIN\r\n",
+		"\r\n",
+		"QUIT\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"-ERR STAT not allowed in this state\r\n",
+		"-ERR unknown command\r\n",
+		"+OK user accepted\r\n", "+OK pass accepted\r\n",
+		"-ERR USER not allowed in this state\r\n",
+		"-ERR AUTH not allowed in this state\r\n",
+		"-ERR unknown command\r\n",
+		"+OK Bye bye!\r\n",
+	)
+}
+
+func TestSessionMaxErrors(t *testing.T) {
+	conf := &ServerConfig{POP: pop{MaxErrors: 3}}
+
+	out := transcriptConf(testBackend(), conf,
+		"FOO\r\n",
+		"STAT\r\n",
+		"NOOP\r\n",
+		"CAPA\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"-ERR unknown command\r\n",
+		"-ERR STAT not allowed in this state\r\n",
+		"-ERR NOOP not allowed in this state\r\n",
+		"-ERR too many errors, closing connection\r\n",
+	)
+
+	// a valid command resets the count
+	out = transcriptConf(testBackend(), conf,
+		"FOO\r\n",
+		"FOO\r\n",
+		"USER user\r\n",
+		"FOO\r\n",
+		"FOO\r\n",
+	)
+	checkTranscript(t, out,
+		greeting,
+		"-ERR unknown command\r\n",
+		"-ERR unknown command\r\n",
+		"+OK user accepted\r\n",
+		"-ERR unknown command\r\n",
+		"-ERR unknown command\r\n",
+	)
+}
+
+// deadlineConn records the calls to the deadline setters and Write
+type deadlineConn struct {
+	io.Reader
+	calls []string
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	c.calls = append(c.calls, "write")
+	return len(p), nil
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.calls = append(c.calls, "read deadline")
+	return nil
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.calls = append(c.calls, "write deadline")
+	return nil
+}
+
+func TestSessionDeadlines(t *testing.T) {
+	Conf = &ServerConfig{}
+	loginLimits = &loginLimiter{failures: make(map[string]*loginFailures)}
+
+	conn := &deadlineConn{Reader: strings.NewReader("USER user\r\nPASS secret\r\nRETR 1\r\n")}
+	newPopSession(conn, testBackend(), nil).run()
+
+	expected := []string{
+		// greeting
+		"read deadline", "write deadline", "write",
+		// USER
+		"read deadline", "write deadline", "write",
+		// PASS
+		"read deadline", "write deadline", "write",
+		// RETR, a deadline for each write of the response
+		"read deadline", "write deadline", "write", "write deadline", "write",
+		// end of input
+		"read deadline",
+	}
+	if !reflect.DeepEqual(conn.calls, expected) {
+		t.Errorf("unexpected calls %q, expected %q", conn.calls, expected)
+	}
+}
+
+func TestPopTimeout(t *testing.T) {
+	tests := []struct {
+		timeout  int
+		expected time.Duration
+	}{
+		{0, 10 * time.Minute},
+		{-1, 10 * time.Minute},
+		{60, 10 * time.Minute},
+		{600, 10 * time.Minute},
+		{3600, time.Hour},
+	}
+
+	for _, test := range tests {
+		Conf = &ServerConfig{POP: pop{Timeout: test.timeout}}
+		if timeout := popTimeout(); timeout != test.expected {
+			t.Errorf("popTimeout() with timeout = %d is %s, expected %s", test.timeout, timeout, test.expected)
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/justinas/nosurf"
-	"github.com/mikkeloscar/goimap"
 )
 
 var templates = map[string]string{
@@ -27,26 +26,29 @@ var store = sessions.NewCookieStore(hashKey, blockKey)
 // AuthCookie defines the name of the auth cookie.
 const AuthCookie = "auth"
 
-// authenticate user via IMAP server
+// authenticate user via IMAP server, unless the password was verified
+// recently
 func userLogin(username string, password string) error {
-	service := fmt.Sprintf("%s:%d", Conf.IMAP.Server, Conf.IMAP.Port)
-
-	conn, err := net.Dial("tcp", service)
-	if err != nil {
-		return err
+	if authCache.Verify(username, password) {
+		return nil
 	}
 
-	client, err := imap.NewClient(conn, Conf.IMAP.Server)
+	client, err := dialIMAP()
 	if err != nil {
 		return err
 	}
+	defer logoutIMAP(client) // close connection to imap server
 
 	err = client.Login(username, password)
 	if err != nil {
+		if loginErrorCode(err) == respAuth {
+			authCache.Forget(username)
+		}
 		return err
 	}
 
-	return client.Close() // close connection to imap server
+	authCache.Store(username, password)
+	return nil
 }
 
 func login(w http.ResponseWriter, r *http.Request) {
@@ -54,14 +56,29 @@ func login(w http.ResponseWriter, r *http.Request) {
 
 	username, password := r.FormValue("username"), r.FormValue("password")
 
-	err := userLogin(username, password)
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !loginLimits.Allowed(ip, username) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	err = userLogin(username, password)
 
 	if err != nil {
+		if loginErrorCode(err) == respAuth {
+			loginLimits.Failed(ip, username)
+		}
 		http.Redirect(w, r, "/", http.StatusFound)
 		Log.Errorf("login error: %s", err)
 		return
 	}
 
+	loginLimits.Succeeded(ip, username)
+
 	session.Values["user"] = username
 	session.Options.MaxAge = 0      // End session when browser session ends
 	session.Options.HttpOnly = true // http-only cookie
@@ -112,6 +129,7 @@ func settings(w http.ResponseWriter, r *http.Request) {
 					FromWhitelist: []string{},
 					ToWhitelist:   []string{},
 					Blacklist:     []string{},
+					Archive:       false,
 				}
 
 				settings.Create() // add user's settings to db
@@ -135,6 +153,7 @@ func settings(w http.ResponseWriter, r *http.Request) {
 				r.Form["from[]"],
 				r.Form["to[]"],
 				r.Form["blacklist[]"],
+				r.Form.Get("archive") == "on",
 			}
 
 			err = settings.Update()
@@ -164,8 +183,9 @@ func index(w http.ResponseWriter, r *http.Request) {
 	renderTemplate(w, "index", nil, "")
 }
 
-// RunWebInterface runs a web interface for gokumail
-func RunWebInterface(port int) {
+// RunWebInterface runs a web interface for gokumail in the background and
+// returns the server so it can be shut down
+func RunWebInterface(port int) *http.Server {
 	r := mux.NewRouter()
 	r.HandleFunc("/login", login).Methods("POST")
 	r.HandleFunc("/logout", logout).Methods("GET")
@@ -180,11 +200,17 @@ func RunWebInterface(port int) {
 	fs := http.FileServer(http.Dir("static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+
 	Log.Infof("HTTP server listening on port: %d", port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-	if err != nil {
-		Log.Errorf("failed to start web interface: %s", err)
-	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			Log.Errorf("failed to start web interface: %s", err)
+		}
+	}()
+
+	return server
 }
 
 func renderTemplate(w http.ResponseWriter, tmpl string, s *Settings, csrf string) {